@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/tabs"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -17,7 +19,7 @@ type BookingProduct struct {
 	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
 	Name      string             `json:"name" bson:"name"`
 	Qty       int                `json:"qty" bson:"qty"`
-	Price     float64            `json:"price" bson:"price"`
+	Price     money.Money        `json:"price" bson:"price"`
 }
 
 type Booking struct {
@@ -25,7 +27,7 @@ type Booking struct {
 	CustomerID  primitive.ObjectID `json:"customerId" bson:"customerId"`
 	TableNumber string             `json:"tableNumber" bson:"tableNumber"`
 	Products    []BookingProduct   `json:"products" bson:"products"`
-	BillTotal   float64            `json:"billTotal" bson:"billTotal"`
+	BillTotal   money.Money        `json:"billTotal" bson:"billTotal"`
 	Status      string             `json:"status" bson:"status"` // open, closed, cancelled
 	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
 	BookingTime time.Time          `json:"bookingTime" bson:"bookingTime"`
@@ -36,6 +38,17 @@ type Booking struct {
 
 // Handler for /api/bookings and /api/bookings/{id}
 func BookingsHandler(w http.ResponseWriter, r *http.Request) {
+	// POST /api/bookings/{id}/split puts the bill on a tab and splits it
+	if parts := splitPath(r.URL.Path); len(parts) == 4 && parts[3] == "split" && r.Method == http.MethodPost {
+		objID, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		tabs.SplitBooking(w, r, objID)
+		return
+	}
 	// GET /api/bookings or /api/bookings/{id}
 	if r.Method == http.MethodGet {
 		parts := splitPath(r.URL.Path)
@@ -3,26 +3,45 @@ package business
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Pricing modes: whether menu prices include VAT, as UK retail prices must,
+// or have it added on top, as on trade quotes
+const (
+	PricingInclusive = "inclusive"
+	PricingExclusive = "exclusive"
+)
+
+// ValidPricingMode reports whether s is a pricing mode; empty means inclusive
+func ValidPricingMode(s string) bool {
+	return s == "" || s == PricingInclusive || s == PricingExclusive
+}
+
 type BusinessInfo struct {
-	CompanyName      string   `json:"companyName" bson:"companyName"`
-	CompanyAddress   string   `json:"companyAddress" bson:"companyAddress"`
-	FinanceEmail     string   `json:"financeEmail" bson:"financeEmail"`
-	VATID            string   `json:"vatId" bson:"vatId"`
-	CompanyRegNumber string   `json:"companyRegNumber" bson:"companyRegNumber"`
-	Phone            string   `json:"phone" bson:"phone"`
-	Website          string   `json:"website" bson:"website"`
-	LogoURL          string   `json:"logoUrl" bson:"logoUrl"`
-	SalesIDPrefix    string   `json:"salesIdPrefix" bson:"salesIdPrefix"`
-	Currency         string   `json:"currency" bson:"currency"`
-	DefaultTaxRate   float64  `json:"defaultTaxRate" bson:"defaultTaxRate"`
+	CompanyName      string  `json:"companyName" bson:"companyName"`
+	CompanyAddress   string  `json:"companyAddress" bson:"companyAddress"`
+	FinanceEmail     string  `json:"financeEmail" bson:"financeEmail"`
+	VATID            string  `json:"vatId" bson:"vatId"`
+	CompanyRegNumber string  `json:"companyRegNumber" bson:"companyRegNumber"`
+	Phone            string  `json:"phone" bson:"phone"`
+	Website          string  `json:"website" bson:"website"`
+	LogoURL          string  `json:"logoUrl" bson:"logoUrl"`
+	SalesIDPrefix    string  `json:"salesIdPrefix" bson:"salesIdPrefix"`
+	Currency         string  `json:"currency" bson:"currency"`
+	DefaultTaxRate   float64 `json:"defaultTaxRate" bson:"defaultTaxRate"`
+	// PricingMode is inclusive (the default) or exclusive; a location may
+	// override it
+	PricingMode      string   `json:"pricingMode" bson:"pricingMode"`
 	BankDetails      string   `json:"bankDetails" bson:"bankDetails"`
 	LegalFooter      string   `json:"legalFooter" bson:"legalFooter"`
 	OpeningHours     string   `json:"openingHours" bson:"openingHours"`
@@ -78,11 +97,28 @@ func SetBusinessInfoHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"error":"invalid input"}`))
 		return
 	}
+	if !ValidPricingMode(info.PricingMode) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"pricingMode must be inclusive or exclusive"}`))
+		return
+	}
+	info.Currency = strings.ToUpper(strings.TrimSpace(info.Currency))
+	if info.Currency != "" && !money.ValidCurrency(info.Currency) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"currency must be a three letter code such as GBP"}`))
+		return
+	}
 	coll, _ := db.GetCollection(businessCollection)
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
-	_, err := coll.ReplaceOne(ctx, bson.M{}, info, options.Replace().SetUpsert(true))
+	// lastSalesNumber is owned by NextSaleNumber; a form saved with a stale
+	// value must not wind the counter back
+	set, err := toSetFields(info)
+	if err == nil {
+		_, err = coll.UpdateOne(ctx, bson.M{}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	}
 	if err != nil {
+		log.Printf("business update error: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error":"db error"}`))
 		return
@@ -90,3 +126,66 @@ func SetBusinessInfoHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(info)
 }
+
+func toSetFields(info BusinessInfo) (bson.M, error) {
+	raw, err := bson.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	var set bson.M
+	if err := bson.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	delete(set, "lastSalesNumber")
+	return set, nil
+}
+
+// Currency returns the code of the currency the business trades in, which
+// every stored amount is in, or money.DefaultCurrency when none is set
+func Currency(ctx context.Context) string {
+	var info struct {
+		Currency string `bson:"currency"`
+	}
+	if coll, err := db.GetCollection(businessCollection); err == nil && coll.FindOne(ctx, bson.M{}).Decode(&info) == nil && info.Currency != "" {
+		return info.Currency
+	}
+	return money.DefaultCurrency
+}
+
+// NextSaleNumber atomically allocates the next sale number and returns it
+// formatted with the business prefix, e.g. HOS-000123.
+func NextSaleNumber(ctx context.Context) (string, int, error) {
+	coll, err := db.GetCollection(businessCollection)
+	if err != nil {
+		return "", 0, err
+	}
+	var info BusinessInfo
+	err = coll.FindOneAndUpdate(ctx, bson.M{},
+		bson.M{"$inc": bson.M{"lastSalesNumber": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&info)
+	if err != nil {
+		return "", 0, err
+	}
+	return FormatSaleNumber(info.SalesIDPrefix, info.LastSalesNumber), info.LastSalesNumber, nil
+}
+
+// ReleaseSaleNumber hands back a number whose sale was never stored. It only
+// succeeds while no later number has been taken, so numbers are never reused.
+func ReleaseSaleNumber(ctx context.Context, n int) bool {
+	coll, err := db.GetCollection(businessCollection)
+	if err != nil {
+		return false
+	}
+	res, err := coll.UpdateOne(ctx, bson.M{"lastSalesNumber": n}, bson.M{"$inc": bson.M{"lastSalesNumber": -1}})
+	return err == nil && res.ModifiedCount == 1
+}
+
+// FormatSaleNumber joins the prefix and a six digit number with a dash
+func FormatSaleNumber(prefix string, n int) string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "-") {
+		prefix += "-"
+	}
+	return fmt.Sprintf("%s%06d", prefix, n)
+}
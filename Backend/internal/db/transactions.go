@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+var (
+	txMu      sync.Mutex
+	txChecked bool
+	txSupport bool
+)
+
+// SupportsTransactions reports whether the server can run multi-document
+// transactions, which needs a replica set or a sharded cluster. A standalone
+// server, as often used in development, can't.
+func SupportsTransactions(ctx context.Context) bool {
+	txMu.Lock()
+	defer txMu.Unlock()
+	if txChecked {
+		return txSupport
+	}
+	client, err := GetMongoClient()
+	if err != nil {
+		return false
+	}
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		// Ask again next time rather than remember a failed check
+		return false
+	}
+	txChecked = true
+	txSupport = hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !txSupport {
+		log.Printf("MongoDB is standalone: writes that should be atomic fall back to undoing failed steps")
+	}
+	return txSupport
+}
+
+// WithTransaction runs fn in a multi-document transaction; the operations fn
+// makes with the context it is given are committed together or not at all.
+// Transient errors, such as a write conflict with another transaction, run
+// fn again, so it must not keep state from an earlier attempt.
+func WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	client, err := GetMongoClient()
+	if err != nil {
+		return err
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	opts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, opts)
+	return err
+}
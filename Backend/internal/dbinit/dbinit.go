@@ -8,6 +8,8 @@ import (
 	"hospos-backend/internal/db"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // SeedData holds initial data for collections
@@ -19,9 +21,26 @@ var AllCollections = []string{
 	"bookings",
 	"locations",
 	"inventory",
+	"stock_movements",
+	"suppliers",
+	"purchase_orders",
+	"stocktakes",
+	"stock_transfers",
+	"stock_batches",
+	"waste",
+	"migrations",
+	"idempotency_keys",
 	"products",
 	"categories",
+	"price_lists",
 	"sales",
+	"tabs",
+	"refunds",
+	"shifts",
+	"kds_stations",
+	"kds_tickets",
+	"printers",
+	"print_jobs",
 	"payments",
 	"receipts",
 	"reminders",
@@ -38,6 +57,72 @@ var SeedData = map[string][]interface{}{
 	},
 }
 
+// Indexes lists the secondary indexes each collection needs
+var Indexes = map[string][]mongo.IndexModel{
+	"inventory": {
+		{Keys: bson.D{{Key: "productId", Value: 1}, {Key: "locationId", Value: 1}}},
+	},
+	"stock_movements": {
+		{Keys: bson.D{{Key: "itemId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+	"stock_batches": {
+		{Keys: bson.D{{Key: "itemId", Value: 1}, {Key: "remaining", Value: 1}}},
+		{Keys: bson.D{{Key: "bestBefore", Value: 1}}},
+	},
+	"sales": {
+		// Sparse so sales posted before numbering don't collide
+		{Keys: bson.D{{Key: "number", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "locationId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "tillId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "customerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "shiftId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "payments.method", Value: 1}, {Key: "createdAt", Value: -1}}},
+		// Sorting by total, with the ID as the cursor tie-break
+		{Keys: bson.D{{Key: "total", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+	"tabs": {
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "locationId", Value: 1}, {Key: "openedAt", Value: -1}}},
+		{Keys: bson.D{{Key: "table", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "parentId", Value: 1}}, Options: options.Index().SetSparse(true)},
+		// A booking's bill goes on one tab
+		{Keys: bson.D{{Key: "bookingId", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	},
+	"refunds": {
+		{Keys: bson.D{{Key: "saleId", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		// A sale can only be voided once
+		{Keys: bson.D{{Key: "saleId", Value: 1}, {Key: "type", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"type": "void"})},
+	},
+	"shifts": {
+		// One open shift per till
+		{Keys: bson.D{{Key: "tillId", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "open"})},
+		{Keys: bson.D{{Key: "tillId", Value: 1}, {Key: "openedAt", Value: -1}}},
+	},
+	"kds_tickets": {
+		{Keys: bson.D{{Key: "stationId", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "tabId", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "saleId", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	},
+	"print_jobs": {
+		// The queue takes the next due job
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "printerId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "saleId", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	},
+	"idempotency_keys": {
+		// Tills only retry within minutes; keep keys for a day
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60)},
+	},
+	"waste": {
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "locationId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+}
+
 // InitDB seeds the database with main information
 func InitDB() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -87,5 +172,18 @@ func InitDB() error {
 			log.Printf("dbinit: seeded %s", collName)
 		}
 	}
-	return nil
+
+	// Create indexes (no-op when they already exist)
+	for collName, models := range Indexes {
+		coll, err := db.GetCollection(collName)
+		if err != nil {
+			log.Printf("dbinit: failed to get collection %s: %v", collName, err)
+			return err
+		}
+		if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+			log.Printf("dbinit: failed to index %s: %v", collName, err)
+			return err
+		}
+	}
+	return RunMigrations()
 }
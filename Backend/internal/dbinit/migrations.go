@@ -0,0 +1,389 @@
+package dbinit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration is a one-off data change. Each runs once; applied migrations are
+// recorded by name in the migrations collection.
+type Migration struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Migrations run in order after the collections and indexes exist. Append
+// new ones at the end and never rename an existing one.
+var Migrations = []Migration{
+	{Name: "0001-sale-created-at", Run: backfillSaleCreatedAt},
+	{Name: "0002-sale-status", Run: backfillSaleStatus},
+	{Name: "0003-money-minor-units", Run: convertMoneyToPence},
+	{Name: "0004-opening-stock", Run: recordOpeningStock},
+	{Name: "0005-drop-sale-status-index", Run: dropSaleStatusIndex},
+}
+
+// RunMigrations applies every migration not yet recorded as done.
+func RunMigrations() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	coll, err := db.GetCollection("migrations")
+	if err != nil {
+		return err
+	}
+	for _, m := range Migrations {
+		err := coll.FindOne(ctx, bson.M{"_id": m.Name}).Err()
+		if err == nil {
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		log.Printf("dbinit: running migration %s", m.Name)
+		if err := m.Run(ctx); err != nil {
+			log.Printf("dbinit: migration %s failed: %v", m.Name, err)
+			return err
+		}
+		if _, err := coll.InsertOne(ctx, bson.M{"_id": m.Name, "appliedAt": time.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillSaleCreatedAt gives sales posted before createdAt was recorded the
+// time embedded in their ObjectID.
+func backfillSaleCreatedAt(ctx context.Context) error {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return err
+	}
+	res, err := coll.UpdateMany(ctx,
+		bson.M{"createdAt": bson.M{"$exists": false}, "_id": bson.M{"$type": "objectId"}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"createdAt": bson.M{"$toDate": "$_id"}}}}},
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("dbinit: backfilled createdAt on %d sales", res.ModifiedCount)
+	return nil
+}
+
+// backfillSaleStatus marks sales stored before statuses as completed so the
+// status filter finds them.
+func backfillSaleStatus(ctx context.Context) error {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return err
+	}
+	res, err := coll.UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"status": "completed"}},
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("dbinit: set status on %d sales", res.ModifiedCount)
+	return nil
+}
+
+// recordOpeningStock gives items that predate the stock ledger an opening
+// stock movement for what they hold, so the ledger total matches their stock
+// and reconciling them doesn't zero it.
+func recordOpeningStock(ctx context.Context) error {
+	items, err := db.GetCollection("inventory")
+	if err != nil {
+		return err
+	}
+	movements, err := db.GetCollection("stock_movements")
+	if err != nil {
+		return err
+	}
+	cur, err := items.Find(ctx, bson.M{"stock": bson.M{"$ne": 0}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	recorded := 0
+	for cur.Next(ctx) {
+		var item struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			LocationID primitive.ObjectID `bson:"locationId,omitempty"`
+			Stock      float64            `bson:"stock"`
+		}
+		if err := cur.Decode(&item); err != nil {
+			return err
+		}
+		err := movements.FindOne(ctx, bson.M{"itemId": item.ID}).Err()
+		if err == nil {
+			continue
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+		m := bson.M{
+			"_id":        primitive.NewObjectID(),
+			"itemId":     item.ID,
+			"type":       "adjustment",
+			"qty":        item.Stock,
+			"user":       "",
+			"reason":     "opening stock",
+			"stockAfter": item.Stock,
+			"createdAt":  time.Now(),
+		}
+		if !item.LocationID.IsZero() {
+			m["locationId"] = item.LocationID
+		}
+		if _, err := movements.InsertOne(ctx, m); err != nil {
+			return err
+		}
+		recorded++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Printf("dbinit: recorded opening stock for %d inventory items", recorded)
+	return nil
+}
+
+// dropSaleStatusIndex drops the index on sales by status: the status is
+// worked out from refunds when read, so nothing queries the stored field.
+func dropSaleStatusIndex(ctx context.Context) error {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return err
+	}
+	_, err = coll.Indexes().DropOne(ctx, "status_1_createdAt_-1")
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+	return err
+}
+
+// moneyFields are the amounts that were stored in major units (12.5) before
+// money was kept as integer pence (1250). A dotted path steps into each
+// element of an array.
+var moneyFields = []struct {
+	Collection string
+	Paths      []string
+}{
+	{"products", []string{"price", "modifiers.price"}},
+	{"price_lists", []string{"prices.price"}},
+	{"sales", []string{"subtotal", "total", "vat", "discount", "serviceCharge", "tips", "paid",
+		"products.price", "products.lineTotal", "payments.amount", "payments.tip",
+		"priceMismatch.total", "priceMismatch.vat", "priceMismatch.discount", "priceMismatch.serviceCharge"}},
+	{"refunds", []string{"amount", "vat", "lines.amount"}},
+	{"payments", []string{"amount", "tip"}},
+	{"tabs", []string{"total", "share", "lines.price", "lines.lineTotal", "payments.amount", "payments.tip"}},
+	{"bookings", []string{"billTotal", "products.price"}},
+	{"suppliers", []string{"products.unitCost"}},
+	{"purchase_orders", []string{"lines.unitCost"}},
+	{"waste", []string{"cost"}},
+	{"stocktakes", []string{"lines.unitCost"}},
+}
+
+// penceMark is set on each document as its amounts are converted, so a run
+// that fails part way and is retried doesn't convert them twice. The marks
+// are removed once every collection is done.
+const penceMark = "_inPence"
+
+// convertedCheckpoint records that every document is converted and only the
+// marks are left to remove
+const convertedCheckpoint = "0003-money-minor-units/converted"
+
+// convertMoneyToPence rewrites stored amounts from major units to integer
+// pence. Every numeric type is converted: clients wrote doubles, but an
+// amount entered by hand may be a whole number (price: 5 is £5). It runs
+// before the server takes requests, so nothing is in pence yet.
+func convertMoneyToPence(ctx context.Context) error {
+	migrations, err := db.GetCollection("migrations")
+	if err != nil {
+		return err
+	}
+	err = migrations.FindOne(ctx, bson.M{"_id": convertedCheckpoint}).Err()
+	if err == mongo.ErrNoDocuments {
+		if err := convertAmounts(ctx); err != nil {
+			return err
+		}
+		if _, err := migrations.InsertOne(ctx, bson.M{"_id": convertedCheckpoint, "appliedAt": time.Now()}); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	collections := []string{"inventory"}
+	for _, mf := range moneyFields {
+		collections = append(collections, mf.Collection)
+	}
+	for _, name := range collections {
+		coll, err := db.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		if _, err := coll.UpdateMany(ctx, bson.M{penceMark: true}, bson.M{"$unset": bson.M{penceMark: ""}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertAmounts converts and marks every document not yet marked
+func convertAmounts(ctx context.Context) error {
+	if err := convertItemCosts(ctx); err != nil {
+		return err
+	}
+	for _, mf := range moneyFields {
+		coll, err := db.GetCollection(mf.Collection)
+		if err != nil {
+			return err
+		}
+		or := bson.A{}
+		for _, p := range mf.Paths {
+			or = append(or, bson.M{p: bson.M{"$type": "number"}})
+		}
+		cur, err := coll.Find(ctx, bson.M{"$or": or, penceMark: bson.M{"$exists": false}})
+		if err != nil {
+			return err
+		}
+		converted := 0
+		for cur.Next(ctx) {
+			var doc bson.M
+			if err := cur.Decode(&doc); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			set := bson.M{penceMark: true}
+			for _, p := range mf.Paths {
+				path := strings.Split(p, ".")
+				if v, changed := toPence(doc[path[0]], path[1:]); changed {
+					set[path[0]] = v
+				}
+			}
+			if _, err := coll.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": set}); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			converted++
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("dbinit: converted amounts to pence on %d %s", converted, mf.Collection)
+	}
+	return nil
+}
+
+// convertItemCosts converts inventory unit costs, which were per base unit.
+// A base unit such as ml can cost less than a penny, so the cost is moved
+// onto the item's largest unit, where it keeps its precision.
+func convertItemCosts(ctx context.Context) error {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return err
+	}
+	cur, err := coll.Find(ctx, bson.M{"unitCost": bson.M{"$type": "number"}, penceMark: bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	converted := 0
+	for cur.Next(ctx) {
+		var item struct {
+			ID       interface{} `bson:"_id"`
+			UnitCost interface{} `bson:"unitCost"`
+			Units    []struct {
+				Name   string  `bson:"name"`
+				Factor float64 `bson:"factor"`
+			} `bson:"units"`
+		}
+		if err := cur.Decode(&item); err != nil {
+			return err
+		}
+		cost, _ := majorUnits(item.UnitCost)
+		set := bson.M{penceMark: true}
+		factor := 1.0
+		for _, u := range item.Units {
+			if u.Name != "" && u.Factor > factor {
+				factor = u.Factor
+				set["costUnit"] = u.Name
+			}
+		}
+		set["unitCost"] = money.FromFloat(cost * factor)
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": item.ID}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+		converted++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	log.Printf("dbinit: converted unit costs to pence on %d inventory", converted)
+	return nil
+}
+
+// majorUnits reads a stored number of major units of any numeric type
+func majorUnits(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(n.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toPence converts the number at path within v to pence, stepping into every
+// element of arrays on the way. It reports whether anything changed.
+func toPence(v interface{}, path []string) (interface{}, bool) {
+	if f, ok := majorUnits(v); ok {
+		if len(path) == 0 {
+			return money.FromFloat(f), true
+		}
+		return v, false
+	}
+	switch d := v.(type) {
+	case bson.A:
+		changed := false
+		for i := range d {
+			if nv, ok := toPence(d[i], path); ok {
+				d[i], changed = nv, true
+			}
+		}
+		return d, changed
+	case bson.M:
+		if len(path) > 0 {
+			if nv, ok := toPence(d[path[0]], path[1:]); ok {
+				d[path[0]] = nv
+				return d, true
+			}
+		}
+	case bson.D:
+		for i := range d {
+			if len(path) > 0 && d[i].Key == path[0] {
+				if nv, ok := toPence(d[i].Value, path[1:]); ok {
+					d[i].Value = nv
+					return d, true
+				}
+			}
+		}
+	}
+	return v, false
+}
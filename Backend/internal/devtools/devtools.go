@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -51,7 +52,7 @@ func SeedTestDataHandler(w http.ResponseWriter, r *http.Request) {
 		prod := bson.M{
 			"_id":      id,
 			"name":     "Product " + strconv.Itoa(i),
-			"price":    float64(5 + rand.Intn(50)),
+			"price":    money.Money(5+rand.Intn(50)) * money.Scale,
 			"category": "Category " + strconv.Itoa(i%3),
 		}
 		productsColl.InsertOne(ctx, prod)
@@ -68,7 +69,7 @@ func SeedTestDataHandler(w http.ResponseWriter, r *http.Request) {
 				"productId": products[prodIdx],
 				"name":      "Product " + strconv.Itoa(prodIdx),
 				"qty":       1 + rand.Intn(3),
-				"price":     float64(5 + rand.Intn(50)),
+				"price":     money.Money(5+rand.Intn(50)) * money.Scale,
 			},
 		}
 		booking := bson.M{
@@ -76,7 +77,7 @@ func SeedTestDataHandler(w http.ResponseWriter, r *http.Request) {
 			"customerId":  customers[custIdx],
 			"tableNumber": strconv.Itoa(1 + (i % 5)),
 			"products":    bookingProducts,
-			"billTotal":   float64(20 + rand.Intn(80)),
+			"billTotal":   money.Money(20+rand.Intn(80)) * money.Scale,
 			"status":      []string{"open", "closed", "cancelled"}[rand.Intn(3)],
 			"createdAt":   now.Add(-time.Duration(rand.Intn(1000)) * time.Hour),
 			"bookingTime": now.Add(time.Duration(rand.Intn(1000)) * time.Hour),
@@ -96,8 +97,8 @@ func SeedTestDataHandler(w http.ResponseWriter, r *http.Request) {
 			"_id":        saleID,
 			"product_id": products[prodIdx],
 			"quantity":   1 + rand.Intn(5),
-			"total":      float64(10 + rand.Intn(90)),
-			"vat":        float64(rand.Intn(20)),
+			"total":      money.Money(10+rand.Intn(90)) * money.Scale,
+			"vat":        money.Money(rand.Intn(20)) * money.Scale,
 		}
 		salesColl.InsertOne(ctx, sale)
 	}
@@ -109,7 +110,7 @@ func SeedTestDataHandler(w http.ResponseWriter, r *http.Request) {
 		pay := bson.M{
 			"_id":     primitive.NewObjectID(),
 			"sale_id": sales[saleIdx],
-			"amount":  float64(10 + rand.Intn(90)),
+			"amount":  money.Money(10+rand.Intn(90)) * money.Scale,
 			"method":  []string{"cash", "card", "online"}[rand.Intn(3)],
 		}
 		paymentsColl.InsertOne(ctx, pay)
@@ -12,6 +12,15 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Discount scopes
+const (
+	// ScopeBasket takes the percentage off the whole sale
+	ScopeBasket = "basket"
+	// ScopeLine takes it off the lines for the discount's products or
+	// categories only
+	ScopeLine = "line"
+)
+
 type Discount struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
 	Name      string             `json:"name"`
@@ -20,6 +29,56 @@ type Discount struct {
 	Code      string             `json:"code,omitempty"`
 	ExpiresAt *time.Time         `json:"expiresAt,omitempty"`
 	Active    bool               `json:"active"`
+	// Scope is basket (the default) or line
+	Scope string `json:"scope,omitempty"`
+	// ProductIDs and Categories pick the lines a line discount applies to
+	ProductIDs []primitive.ObjectID `json:"productIds,omitempty"`
+	Categories []string             `json:"categories,omitempty"`
+}
+
+// LineLevel reports whether the discount comes off some lines only
+func (d *Discount) LineLevel() bool {
+	return d.Scope == ScopeLine
+}
+
+// AppliesTo reports whether a line discount covers a product
+func (d *Discount) AppliesTo(productID primitive.ObjectID, category string) bool {
+	for _, id := range d.ProductIDs {
+		if id == productID {
+			return true
+		}
+	}
+	for _, c := range d.Categories {
+		if category != "" && strings.EqualFold(c, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the discount has run out at t
+func (d *Discount) Expired(t time.Time) bool {
+	return d.ExpiresAt != nil && d.ExpiresAt.Before(t)
+}
+
+// validate checks the amount and scope of a discount being saved
+func (d *Discount) validate() string {
+	if d.Percent <= 0 || d.Percent > 100 {
+		return "percent must be more than 0 and at most 100"
+	}
+	d.Scope = strings.ToLower(d.Scope)
+	switch d.Scope {
+	case "":
+		d.Scope = ScopeBasket
+	case ScopeBasket:
+	case ScopeLine:
+		if len(d.ProductIDs) == 0 && len(d.Categories) == 0 {
+			return "a line discount needs productIds or categories"
+		}
+	default:
+		return "scope must be 'basket' or 'line'"
+	}
+	return ""
 }
 
 var collectionName = "discounts"
@@ -78,6 +137,11 @@ func DiscountsHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`{"error":"code required for code-based discount"}`))
 			return
 		}
+		if msg := d.validate(); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
 		if d.ExpiresAt != nil {
 			d.Active = d.ExpiresAt.After(time.Now())
 		} else {
@@ -113,14 +177,22 @@ func DiscountsHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`{"error":"invalid input"}`))
 			return
 		}
+		if msg := d.validate(); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
 		update := bson.M{
 			"$set": bson.M{
-				"name":      d.Name,
-				"percent":   d.Percent,
-				"type":      d.Type,
-				"code":      d.Code,
-				"expiresat": d.ExpiresAt,
-				"active":    d.Active,
+				"name":       d.Name,
+				"percent":    d.Percent,
+				"type":       d.Type,
+				"code":       d.Code,
+				"expiresat":  d.ExpiresAt,
+				"active":     d.Active,
+				"scope":      d.Scope,
+				"productids": d.ProductIDs,
+				"categories": d.Categories,
 			},
 		}
 		_, err = coll.UpdateByID(r.Context(), oid, update)
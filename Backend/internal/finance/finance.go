@@ -7,14 +7,34 @@ import (
 	"net/http"
 	"time"
 
+	"hospos-backend/internal/business"
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/inventory"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type FinanceSummary struct {
-	TotalSales    float64 `json:"totalSales"`
-	TotalVAT      float64 `json:"totalVAT"`
-	TotalPayments float64 `json:"totalPayments"`
-	TotalReceipts int     `json:"totalReceipts"`
+	// Currency is the code every amount in the summary is in
+	Currency string `json:"currency"`
+	// GrossSales is takings before refunds and voids; TotalSales and TotalVAT
+	// are net of them. Sales totals include VAT whatever the pricing mode;
+	// TotalNet is TotalSales less TotalVAT.
+	GrossSales   money.Money `json:"grossSales"`
+	TotalRefunds money.Money `json:"totalRefunds"`
+	TotalVoids   money.Money `json:"totalVoids"`
+	TotalSales   money.Money `json:"totalSales"`
+	TotalVAT     money.Money `json:"totalVAT"`
+	TotalNet     money.Money `json:"totalNet"`
+	// Service charge is within the sales totals; tips are on top of them
+	TotalServiceCharge money.Money `json:"totalServiceCharge"`
+	TotalTips          money.Money `json:"totalTips"`
+	TotalPayments      money.Money `json:"totalPayments"`
+	TotalReceipts      int         `json:"totalReceipts"`
+	// TotalWaste is stock written off, at cost
+	TotalWaste    money.Money            `json:"totalWaste"`
+	WasteByReason map[string]money.Money `json:"wasteByReason"`
 }
 
 // GET /api/finance/summary
@@ -34,29 +54,56 @@ func FinanceSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"error":"db error"}`))
 		return
 	}
-	var salesTotal, vatTotal float64
+	var salesTotal, vatTotal, serviceTotal, tipsTotal money.Money
 	cur, err := salesColl.Find(ctx, map[string]interface{}{})
 	if err == nil {
 		var sales []struct {
-			Total float64 `json:"total"`
-			VAT   float64 `json:"vat"`
+			Total         money.Money `json:"total"`
+			VAT           money.Money `json:"vat"`
+			ServiceCharge money.Money `bson:"serviceCharge"`
+			Tips          money.Money `bson:"tips"`
 		}
 		if err := cur.All(ctx, &sales); err == nil {
 			for _, s := range sales {
 				salesTotal += s.Total
 				vatTotal += s.VAT
+				serviceTotal += s.ServiceCharge
+				tipsTotal += s.Tips
+			}
+		}
+	}
+
+	// Refunds and voids are separate reversing entries
+	var refundsTotal, voidsTotal, refundVAT money.Money
+	if refundsColl, err := db.GetCollection("refunds"); err == nil {
+		cur, err := refundsColl.Find(ctx, map[string]interface{}{})
+		if err == nil {
+			var refunds []struct {
+				Type   string      `bson:"type"`
+				Amount money.Money `bson:"amount"`
+				VAT    money.Money `bson:"vat"`
+			}
+			if err := cur.All(ctx, &refunds); err == nil {
+				for _, rf := range refunds {
+					if rf.Type == "void" {
+						voidsTotal += rf.Amount
+					} else {
+						refundsTotal += rf.Amount
+					}
+					refundVAT += rf.VAT
+				}
 			}
 		}
 	}
 
 	// Aggregate payments
 	paymentsColl, err := db.GetCollection("payments")
-	var paymentsTotal float64
+	var paymentsTotal money.Money
 	if err == nil {
 		cur, err := paymentsColl.Find(ctx, map[string]interface{}{})
 		if err == nil {
 			var payments []struct {
-				Amount float64 `json:"amount"`
+				Amount money.Money `json:"amount"`
 			}
 			if err := cur.All(ctx, &payments); err == nil {
 				for _, p := range payments {
@@ -76,11 +123,32 @@ func FinanceSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Waste at cost
+	wasteByReason := map[string]money.Money{}
+	var wasteTotal money.Money
+	if waste, err := inventory.Waste(ctx, primitive.NilObjectID, nil, nil); err == nil {
+		wasteTotal = waste.TotalCost
+		for _, t := range waste.ByReason {
+			wasteByReason[t.Key] = t.Cost
+		}
+	} else {
+		log.Printf("waste report error: %v", err)
+	}
+
 	summary := FinanceSummary{
-		TotalSales:    salesTotal,
-		TotalVAT:      vatTotal,
-		TotalPayments: paymentsTotal,
-		TotalReceipts: receiptsCount,
+		Currency:           business.Currency(ctx),
+		GrossSales:         salesTotal,
+		TotalRefunds:       refundsTotal,
+		TotalVoids:         voidsTotal,
+		TotalSales:         salesTotal - refundsTotal - voidsTotal,
+		TotalVAT:           vatTotal - refundVAT,
+		TotalNet:           salesTotal - refundsTotal - voidsTotal - (vatTotal - refundVAT),
+		TotalServiceCharge: serviceTotal,
+		TotalTips:          tipsTotal,
+		TotalPayments:      paymentsTotal,
+		TotalReceipts:      receiptsCount,
+		TotalWaste:         wasteTotal,
+		WasteByReason:      wasteByReason,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(summary)
@@ -0,0 +1,186 @@
+// Package idempotency lets tills safely resend a POST after a timeout. A
+// request carrying an Idempotency-Key header is processed once; repeats with
+// the same key get the stored response back instead of running again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Header is the request header carrying the client's key
+	Header         = "Idempotency-Key"
+	collectionName = "idempotency_keys"
+	maxKeyLength   = 255
+	// A key still pending after this long belongs to a request that never
+	// finished, and may be taken over by a retry
+	abandonAfter = time.Minute
+)
+
+const (
+	statePending = "pending"
+	stateDone    = "done"
+)
+
+// record is a stored key. ID is the endpoint path and key together, so the
+// same key sent to two endpoints counts as two requests. Keys are removed by
+// a TTL index a day after they were first seen.
+type record struct {
+	ID        string    `bson:"_id"`
+	BodyHash  string    `bson:"bodyHash"`
+	State     string    `bson:"state"`
+	Status    int       `bson:"status,omitempty"`
+	Response  []byte    `bson:"response,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// recorder passes a response through while keeping a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Handler makes POSTs to h idempotent when they carry an Idempotency-Key.
+// Successful responses are stored and replayed for repeats with the same
+// body; a repeat with a different body gets 409. Failed requests release the
+// key so the retry is processed afresh.
+func Handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(Header))
+		if r.Method != http.MethodPost || key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"idempotency key too long"}`))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		coll, err := db.GetCollection(collectionName)
+		if err != nil {
+			log.Printf("db error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		id := strings.TrimSuffix(r.URL.Path, "/") + " " + key
+		claim := record{ID: id, BodyHash: hex.EncodeToString(sum[:]), State: statePending, CreatedAt: time.Now()}
+		prev, err := reserve(ctx, coll, claim)
+		if err != nil {
+			log.Printf("idempotency error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if prev != nil {
+			switch {
+			case prev.BodyHash != claim.BodyHash:
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":"idempotency key was used for a different request"}`))
+			case prev.State == statePending:
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":"request with this idempotency key is still in progress"}`))
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(prev.Status)
+				w.Write(prev.Response)
+			}
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		// Deferred so a panicking handler releases the key too
+		defer finish(coll, id, rec)
+		h(rec, r)
+	}
+}
+
+// finish stores a successful response against its key, or releases the key
+// after a failure
+func finish(coll *mongo.Collection, id string, rec *recorder) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if rec.status < 200 || rec.status >= 300 {
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": id, "state": statePending}); err != nil {
+			log.Printf("idempotency release error for %q: %v", id, err)
+		}
+		return
+	}
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"state": stateDone, "status": rec.status, "response": rec.body.Bytes(),
+	}})
+	if err != nil {
+		log.Printf("idempotency save error for %q: %v", id, err)
+	}
+}
+
+// reserve claims a key for this request. If the key is already held it
+// returns the existing record instead, unless that was abandoned mid-request,
+// in which case the claim takes it over.
+func reserve(ctx context.Context, coll *mongo.Collection, claim record) (*record, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := coll.InsertOne(ctx, claim)
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		var prev record
+		if err := coll.FindOne(ctx, bson.M{"_id": claim.ID}).Decode(&prev); err == mongo.ErrNoDocuments {
+			// Released in the meantime; try again
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if prev.State != statePending || prev.BodyHash != claim.BodyHash || time.Since(prev.CreatedAt) < abandonAfter {
+			return &prev, nil
+		}
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": claim.ID, "state": statePending, "createdAt": prev.CreatedAt}); err != nil {
+			return nil, err
+		}
+	}
+	return &claim, nil
+}
@@ -0,0 +1,143 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/notify"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StockAlert is an item at or below its reorder point
+type StockAlert struct {
+	Item           InventoryItem `json:"item"`
+	SuggestedOrder float64       `json:"suggestedOrder"`
+}
+
+// suggestedOrder returns how much to order to get back to par. Items without
+// a par level are topped up to their reorder point.
+func suggestedOrder(item InventoryItem) float64 {
+	target := item.ParLevel
+	if target <= 0 {
+		target = item.ReorderPoint
+	}
+	if qty := target - item.Stock; qty > 0 {
+		return qty
+	}
+	return 0
+}
+
+// belowThreshold reports whether an item needs reordering
+func belowThreshold(item InventoryItem) bool {
+	return item.ReorderPoint > 0 && item.Stock <= item.ReorderPoint
+}
+
+// Alerts lists every item at or below its reorder point, optionally for a
+// single location.
+func Alerts(ctx context.Context, location primitive.ObjectID) ([]StockAlert, error) {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		"reorderPoint": bson.M{"$gt": 0},
+		"$expr":        bson.M{"$lte": bson.A{"$stock", "$reorderPoint"}},
+	}
+	if !location.IsZero() {
+		filter["locationId"] = location
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var items []InventoryItem
+	if err := cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	alerts := []StockAlert{}
+	for _, item := range items {
+		alerts = append(alerts, StockAlert{Item: item, SuggestedOrder: suggestedOrder(item)})
+	}
+	return alerts, nil
+}
+
+// checkThreshold is called after every stock change. The first time an item
+// drops to its reorder point a notification is sent and the item is flagged;
+// the flag is cleared once stock is back above the reorder point, so each
+// shortage is only alerted once. Under DeferAlerts the notification is held
+// rather than sent.
+func checkThreshold(ctx context.Context, item InventoryItem) {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return
+	}
+	if belowThreshold(item) {
+		if item.Alerted {
+			return
+		}
+		// Only the caller that flips the flag sends the alert
+		res, err := coll.UpdateOne(ctx, bson.M{"_id": item.ID, "alerted": bson.M{"$ne": true}}, bson.M{"$set": bson.M{"alerted": true}})
+		if err != nil || res.ModifiedCount == 0 {
+			return
+		}
+		alert := StockAlert{Item: item, SuggestedOrder: suggestedOrder(item)}
+		if p, ok := ctx.Value(pendingAlertsKey{}).(*PendingAlerts); ok {
+			p.alerts = append(p.alerts, alert)
+			return
+		}
+		go sendAlert(alert)
+		return
+	}
+	if item.Alerted {
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": item.ID}, bson.M{"$set": bson.M{"alerted": false}}); err != nil {
+			log.Printf("alert reset error for %s: %v", item.ID.Hex(), err)
+		}
+	}
+}
+
+// PendingAlerts holds the alerts raised by stock changes made in a
+// transaction, to be sent once it commits
+type PendingAlerts struct {
+	alerts []StockAlert
+}
+
+type pendingAlertsKey struct{}
+
+// DeferAlerts returns a context under which stock alerts are held in the
+// returned PendingAlerts rather than sent straight away. Call it inside the
+// transaction so a retried attempt starts with none.
+func DeferAlerts(ctx context.Context) (context.Context, *PendingAlerts) {
+	p := &PendingAlerts{}
+	return context.WithValue(ctx, pendingAlertsKey{}, p), p
+}
+
+// Send sends the held alerts. A nil PendingAlerts sends nothing.
+func (p *PendingAlerts) Send() {
+	if p == nil {
+		return
+	}
+	for _, alert := range p.alerts {
+		go sendAlert(alert)
+	}
+	p.alerts = nil
+}
+
+func sendAlert(alert StockAlert) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	msg := notify.Message{
+		Subject: fmt.Sprintf("Low stock: %s", alert.Item.Product),
+		Body: fmt.Sprintf("%s is at %g %s (reorder point %g). Suggested order: %g.",
+			alert.Item.Product, alert.Item.Stock, alert.Item.BaseUnit, alert.Item.ReorderPoint, alert.SuggestedOrder),
+		Data: alert,
+	}
+	if err := notify.Default().Notify(ctx, msg); err != nil {
+		log.Printf("stock alert error for %s: %v", alert.Item.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,391 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const batchesCollection = "stock_batches"
+
+// Batch is a lot of an item received together, with what is left of it.
+// Quantities are in the item's base unit.
+type Batch struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ItemID     primitive.ObjectID `json:"itemId" bson:"itemId"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Product    string             `json:"product" bson:"product"`
+	Batch      string             `json:"batch,omitempty" bson:"batch,omitempty"`
+	BestBefore *time.Time         `json:"bestBefore,omitempty" bson:"bestBefore,omitempty"`
+	Received   float64            `json:"received" bson:"received"`
+	Remaining  float64            `json:"remaining" bson:"remaining"`
+	ReceivedAt time.Time          `json:"receivedAt" bson:"receivedAt"`
+}
+
+// BatchUse records how much of a batch a movement took
+type BatchUse struct {
+	BatchID    primitive.ObjectID `json:"batchId" bson:"batchId"`
+	Batch      string             `json:"batch,omitempty" bson:"batch,omitempty"`
+	BestBefore *time.Time         `json:"bestBefore,omitempty" bson:"bestBefore,omitempty"`
+	Quantity   float64            `json:"qty" bson:"qty"`
+}
+
+// ExpiringBatch is a line of the expiry report
+type ExpiringBatch struct {
+	Batch
+	Value   money.Money `json:"value"`
+	Expired bool        `json:"expired"`
+}
+
+// applyBatches keeps an item's batches in step with a movement. Receipts that
+// name a batch or best-before date open a new batch; movements carrying batch
+// uses (reversals and transfers in) put those quantities back; removals take
+// from open batches, soonest expiry first. Batch bookkeeping never blocks a
+// movement, so errors are only logged. The changes made are returned so they
+// can be undone if the movement isn't recorded.
+func applyBatches(ctx context.Context, m *StockMovement, item InventoryItem) batchChanges {
+	var (
+		ch  batchChanges
+		err error
+	)
+	switch {
+	case m.Quantity > 0 && len(m.Batches) > 0:
+		ch, err = returnBatches(ctx, m, item)
+	case m.Quantity > 0 && (m.Batch != "" || m.BestBefore != nil):
+		var b *Batch
+		if b, err = openBatch(ctx, item, m.Batch, m.BestBefore, m.Quantity, m.CreatedAt); err == nil {
+			ch.opened = append(ch.opened, b.ID)
+		}
+	case m.Quantity < 0:
+		m.Batches, err = consumeBatches(ctx, m.ItemID, m.BatchID, m.Batch, -m.Quantity)
+		for _, use := range m.Batches {
+			ch.changed = append(ch.changed, BatchUse{BatchID: use.BatchID, Quantity: -use.Quantity})
+		}
+	}
+	if err != nil {
+		log.Printf("batch error for %s: %v", m.ItemID.Hex(), err)
+	}
+	return ch
+}
+
+// batchChanges is what applyBatches did: the batches it opened and the
+// quantities it added to (positive) or took from (negative) existing ones
+type batchChanges struct {
+	opened  []primitive.ObjectID
+	changed []BatchUse
+}
+
+// undo reverses the changes, removing opened batches and putting back what
+// was taken. Like applyBatches it only logs errors.
+func (ch batchChanges) undo(ctx context.Context) {
+	if len(ch.opened) == 0 && len(ch.changed) == 0 {
+		return
+	}
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		log.Printf("batch undo error: %v", err)
+		return
+	}
+	if len(ch.opened) > 0 {
+		if _, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ch.opened}}); err != nil {
+			log.Printf("batch undo error: %v", err)
+		}
+	}
+	for _, c := range ch.changed {
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": c.BatchID}, bson.M{"$inc": bson.M{"remaining": -c.Quantity}}); err != nil {
+			log.Printf("batch undo error for %s: %v", c.BatchID.Hex(), err)
+		}
+	}
+}
+
+func openBatch(ctx context.Context, item InventoryItem, lot string, bestBefore *time.Time, qty float64, at time.Time) (*Batch, error) {
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		return nil, err
+	}
+	b := &Batch{
+		ID:         primitive.NewObjectID(),
+		ItemID:     item.ID,
+		LocationID: item.LocationID,
+		Product:    item.Product,
+		Batch:      lot,
+		BestBefore: bestBefore,
+		Received:   qty,
+		Remaining:  qty,
+		ReceivedAt: at,
+	}
+	_, err = coll.InsertOne(ctx, b)
+	return b, err
+}
+
+// returnBatches puts quantities back into the batches they came from. A batch
+// belonging to another item, as with stock arriving from a transfer, is
+// recreated under this item with the same lot and date.
+func returnBatches(ctx context.Context, m *StockMovement, item InventoryItem) (batchChanges, error) {
+	var ch batchChanges
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		return ch, err
+	}
+	for i, use := range m.Batches {
+		res, err := coll.UpdateOne(ctx,
+			bson.M{"_id": use.BatchID, "itemId": m.ItemID},
+			bson.M{"$inc": bson.M{"remaining": use.Quantity}})
+		if err != nil {
+			return ch, err
+		}
+		if res.MatchedCount > 0 {
+			ch.changed = append(ch.changed, BatchUse{BatchID: use.BatchID, Quantity: use.Quantity})
+			continue
+		}
+		b, err := openBatch(ctx, item, use.Batch, use.BestBefore, use.Quantity, m.CreatedAt)
+		if err != nil {
+			return ch, err
+		}
+		ch.opened = append(ch.opened, b.ID)
+		m.Batches[i].BatchID = b.ID
+	}
+	return ch, nil
+}
+
+// consumeBatches takes qty from an item's open batches. A chosen batch or
+// named lot is used first; after that batches go in order of best-before date,
+// then the oldest undated ones. Stock beyond what the batches hold is simply
+// not batch tracked.
+func consumeBatches(ctx context.Context, itemID, batchID primitive.ObjectID, lot string, qty float64) ([]BatchUse, error) {
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		return nil, err
+	}
+	open, err := openBatches(ctx, bson.M{"itemId": itemID})
+	if err != nil {
+		return nil, err
+	}
+	rank := func(b Batch) int {
+		switch {
+		case !batchID.IsZero() && b.ID == batchID:
+			return 0
+		case lot != "" && b.Batch == lot:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(open, func(i, j int) bool { return rank(open[i]) < rank(open[j]) })
+	var uses []BatchUse
+	for _, b := range open {
+		if qty <= 0 {
+			break
+		}
+		take := b.Remaining
+		if take > qty {
+			take = qty
+		}
+		// Only take what is still there if another movement got in first
+		res, err := coll.UpdateOne(ctx,
+			bson.M{"_id": b.ID, "remaining": bson.M{"$gte": take}},
+			bson.M{"$inc": bson.M{"remaining": -take}})
+		if err != nil {
+			return uses, err
+		}
+		if res.MatchedCount == 0 {
+			continue
+		}
+		uses = append(uses, BatchUse{BatchID: b.ID, Batch: b.Batch, BestBefore: b.BestBefore, Quantity: take})
+		qty = roundQty(qty - take)
+	}
+	return uses, nil
+}
+
+// openBatches lists batches with stock left matching filter, in FIFO order
+func openBatches(ctx context.Context, filter bson.M) ([]Batch, error) {
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		return nil, err
+	}
+	filter["remaining"] = bson.M{"$gt": 0}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	batches := []Batch{}
+	if err := cur.All(ctx, &batches); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(batches, func(i, j int) bool {
+		a, b := batches[i], batches[j]
+		switch {
+		case a.BestBefore != nil && b.BestBefore != nil && !a.BestBefore.Equal(*b.BestBefore):
+			return a.BestBefore.Before(*b.BestBefore)
+		case a.BestBefore != nil && b.BestBefore == nil:
+			return true
+		case a.BestBefore == nil && b.BestBefore != nil:
+			return false
+		}
+		return a.ReceivedAt.Before(b.ReceivedAt)
+	})
+	return batches, nil
+}
+
+// Expiring lists open batches whose best-before date falls within the given
+// number of days, including those already past it, optionally for one location.
+func Expiring(ctx context.Context, location primitive.ObjectID, days int) ([]ExpiringBatch, error) {
+	now := time.Now()
+	filter := bson.M{"bestBefore": bson.M{"$lte": now.AddDate(0, 0, days)}}
+	if !location.IsZero() {
+		filter["locationId"] = location
+	}
+	batches, err := openBatches(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	items := map[primitive.ObjectID]InventoryItem{}
+	if len(batches) > 0 {
+		coll, err := db.GetCollection("inventory")
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]primitive.ObjectID, 0, len(batches))
+		for _, b := range batches {
+			ids = append(ids, b.ItemID)
+		}
+		cur, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, err
+		}
+		var found []InventoryItem
+		if err := cur.All(ctx, &found); err != nil {
+			return nil, err
+		}
+		for _, item := range found {
+			items[item.ID] = item
+		}
+	}
+	report := make([]ExpiringBatch, 0, len(batches))
+	for _, b := range batches {
+		item := items[b.ItemID]
+		report = append(report, ExpiringBatch{
+			Batch:   b,
+			Value:   item.CostOf(b.Remaining),
+			Expired: b.BestBefore.Before(now),
+		})
+	}
+	return report, nil
+}
+
+// expiringHandler handles GET /api/inventory/expiring?days=N&locationId=
+func expiringHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	days := 7
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid days"}`))
+			return
+		}
+		days = n
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	loc, _ := locationParam(r)
+	report, err := Expiring(ctx, loc, days)
+	if err != nil {
+		log.Printf("expiring error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// batchHandler handles GET /api/inventory/batches/{id} and
+// POST /api/inventory/batches/{id}/write-off
+func batchHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	coll, err := db.GetCollection(batchesCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var b Batch
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&b); err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	case action == "write-off" && r.Method == http.MethodPost:
+		if b.Remaining <= 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"batch is empty"}`))
+			return
+		}
+		var req struct {
+			User string `json:"user"`
+			Note string `json:"note"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Note == "" {
+			req.Note = "expired batch"
+		}
+		if name := requestUserName(ctx, r); name != "" {
+			req.User = name
+		}
+		rec := WasteRecord{
+			ItemID:  b.ItemID,
+			BatchID: b.ID,
+			// Quantity is in the base unit, as batches are
+			Quantity: b.Remaining,
+			Reason:   WasteSpoiled,
+			Note:     req.Note,
+			User:     req.User,
+		}
+		if err := LogWaste(ctx, &rec); err != nil {
+			log.Printf("write-off error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rec)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
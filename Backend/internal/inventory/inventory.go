@@ -8,20 +8,108 @@ import (
 	"time"
 
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type InventoryItem struct {
-	ID      primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Product string             `json:"product" bson:"product"`
-	Stock   int                `json:"stock" bson:"stock"`
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Product   string             `json:"product" bson:"product"`
+	ProductID primitive.ObjectID `json:"productId,omitempty" bson:"productId,omitempty"`
+	// LocationID is the site holding the stock; items without one are shared
+	// stock used by any location that has no item of its own
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	// Stock and all thresholds are in BaseUnit
+	Stock    float64 `json:"stock" bson:"stock"`
+	BaseUnit string  `json:"baseUnit" bson:"baseUnit"`
+	// Units lists the other units the item is bought, sold or counted in
+	Units []UnitConversion `json:"units" bson:"units"`
+	// Untracked items are never decremented by sales
+	Untracked bool `json:"untracked" bson:"untracked"`
+	// BlockNegative rejects sales that would take stock below zero; otherwise
+	// the sale goes through with a warning
+	BlockNegative bool `json:"blockNegative" bson:"blockNegative"`
+	// ParLevel is the stock to order back up to; ReorderPoint is the level
+	// at which an alert is raised
+	ParLevel     float64 `json:"parLevel" bson:"parLevel"`
+	ReorderPoint float64 `json:"reorderPoint" bson:"reorderPoint"`
+	// UnitCost is the weighted average cost of stock on hand, per CostUnit:
+	// one of Units, such as the bottle or case it is bought in, or BaseUnit
+	// when empty. Costing a larger unit keeps small base units such as ml
+	// to the penny.
+	UnitCost money.Money `json:"unitCost" bson:"unitCost"`
+	CostUnit string      `json:"costUnit,omitempty" bson:"costUnit,omitempty"`
+	// Alerted is set while a low-stock alert is outstanding
+	Alerted   bool      `json:"alerted" bson:"alerted"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// itemUpdate holds the item settings that can be changed with PATCH. Stock is
+// deliberately absent: it only changes through movements.
+type itemUpdate struct {
+	Product       *string             `json:"product"`
+	ProductID     *primitive.ObjectID `json:"productId"`
+	Untracked     *bool               `json:"untracked"`
+	BlockNegative *bool               `json:"blockNegative"`
+	BaseUnit      *string             `json:"baseUnit"`
+	Units         *[]UnitConversion   `json:"units"`
+	ParLevel      *float64            `json:"parLevel"`
+	ReorderPoint  *float64            `json:"reorderPoint"`
+}
+
+func (u itemUpdate) fields() bson.M {
+	set := bson.M{}
+	if u.Product != nil {
+		set["product"] = *u.Product
+	}
+	if u.ProductID != nil {
+		set["productId"] = *u.ProductID
+	}
+	if u.Untracked != nil {
+		set["untracked"] = *u.Untracked
+	}
+	if u.BlockNegative != nil {
+		set["blockNegative"] = *u.BlockNegative
+	}
+	if u.BaseUnit != nil {
+		set["baseUnit"] = *u.BaseUnit
+	}
+	if u.Units != nil {
+		set["units"] = *u.Units
+	}
+	if u.ParLevel != nil {
+		set["parLevel"] = *u.ParLevel
+	}
+	if u.ReorderPoint != nil {
+		set["reorderPoint"] = *u.ReorderPoint
+	}
+	return set
 }
 
 // No in-memory inventory; use MongoDB
 
+// InventoryHandler handles /api/inventory and /api/inventory/{id}/...
 func InventoryHandler(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 3 && parts[2] == "alerts" {
+		alertsHandler(w, r)
+		return
+	}
+	if len(parts) == 3 && parts[2] == "expiring" {
+		expiringHandler(w, r)
+		return
+	}
+	if len(parts) >= 4 && parts[2] == "batches" {
+		batchHandler(w, r, parts[3:])
+		return
+	}
+	if len(parts) >= 3 && parts[2] != "" {
+		itemHandler(w, r, parts[2:])
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		coll, err := db.GetCollection("inventory")
@@ -33,7 +121,11 @@ func InventoryHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
-		cur, err := coll.Find(ctx, bson.M{})
+		filter := bson.M{}
+		if loc, ok := locationParam(r); ok {
+			filter["locationId"] = loc
+		}
+		cur, err := coll.Find(ctx, filter)
 		if err != nil {
 			log.Printf("find error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -59,6 +151,15 @@ func InventoryHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`{"error":"invalid input"}`))
 			return
 		}
+		if _, err := item.UnitFactor(item.CostUnit); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"costUnit must be one of the item's units"}`))
+			return
+		}
+		// Opening stock goes through the ledger like any other change
+		opening := item.Stock
+		item.Stock = 0
+		item.UpdatedAt = time.Now()
 		coll, err := db.GetCollection("inventory")
 		if err != nil {
 			log.Printf("db error: %v", err)
@@ -76,6 +177,16 @@ func InventoryHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		item.ID = res.InsertedID.(primitive.ObjectID)
+		if opening != 0 {
+			m := StockMovement{ItemID: item.ID, Type: MovementAdjustment, Quantity: opening, Reason: "opening stock"}
+			if err := RecordMovement(ctx, &m); err != nil {
+				log.Printf("opening stock error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			item.Stock = m.StockAfter
+		}
 		w.WriteHeader(http.StatusCreated)
 		if err := json.NewEncoder(w).Encode(item); err != nil {
 			log.Printf("encode error: %v", err)
@@ -84,3 +195,212 @@ func InventoryHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// itemHandler handles /api/inventory/{id}, /api/inventory/{id}/movements and
+// /api/inventory/{id}/reconcile
+func itemHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		var item InventoryItem
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&item); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+	case action == "" && r.Method == http.MethodPatch:
+		var u itemUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		set := u.fields()
+		if len(set) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"no fields to update"}`))
+			return
+		}
+		var item InventoryItem
+		if u.Units != nil || u.BaseUnit != nil {
+			// The unit the cost is held in must survive the change
+			if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&item); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+				return
+			}
+			if u.Units != nil {
+				item.Units = *u.Units
+			}
+			if u.BaseUnit != nil {
+				item.BaseUnit = *u.BaseUnit
+			}
+			if _, err := item.UnitFactor(item.CostUnit); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"units must keep the item's costUnit"}`))
+				return
+			}
+		}
+		set["updatedAt"] = time.Now()
+		err := coll.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&item)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		// A new reorder point may put the item above or below threshold
+		checkThreshold(ctx, item)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+	case action == "movements" && r.Method == http.MethodGet:
+		history, err := ItemHistory(ctx, id)
+		if err != nil {
+			log.Printf("history error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	case action == "movements" && r.Method == http.MethodPost:
+		var m StockMovement
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		m.ItemID = id
+		m.Batches = nil
+		// Attributed to whoever is signed in, never to a name in the body
+		m.User = requestUserName(ctx, r)
+		if err := RecordMovement(ctx, &m); err != nil {
+			switch err {
+			case ErrInvalidMovement:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid movement"}`))
+			case ErrUnknownUnit:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"unknown unit"}`))
+			case ErrItemNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+			default:
+				log.Printf("movement error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+			}
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m)
+	case action == "batches" && r.Method == http.MethodGet:
+		batches, err := openBatches(ctx, bson.M{"itemId": id})
+		if err != nil {
+			log.Printf("batches error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batches)
+	case action == "reconcile" && r.Method == http.MethodPost:
+		// Reset the cached stock figure to the ledger total
+		var item InventoryItem
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&item); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		// An item from before the ledger has no entries and would reset
+		// to zero; its opening stock must be recorded first
+		recorded, err := hasLedger(ctx, id)
+		if err != nil {
+			log.Printf("ledger error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if !recorded && item.Stock != 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"item has no ledger entries to reconcile against"}`))
+			return
+		}
+		ledger, err := LedgerStock(ctx, id)
+		if err != nil {
+			log.Printf("ledger error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if ledger != item.Stock {
+			res, err := coll.UpdateOne(ctx, bson.M{"_id": id, "stock": item.Stock}, bson.M{"$set": bson.M{"stock": ledger, "updatedAt": time.Now()}})
+			if err != nil {
+				log.Printf("reconcile error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			if res.MatchedCount == 0 {
+				// A movement landed in between; the caller can simply retry
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":"stock changed during reconcile"}`))
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]float64{
+			"stock":  ledger,
+			"cached": item.Stock,
+			"drift":  item.Stock - ledger,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// alertsHandler handles GET /api/inventory/alerts
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	loc, _ := locationParam(r)
+	alerts, err := Alerts(ctx, loc)
+	if err != nil {
+		log.Printf("alerts error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// locationParam reads the optional ?locationId= query parameter
+func locationParam(r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("locationId"))
+	return id, err == nil
+}
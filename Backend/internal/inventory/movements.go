@@ -0,0 +1,208 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Movement types recorded in the stock ledger
+const (
+	MovementReceipt    = "receipt"
+	MovementSale       = "sale"
+	MovementWaste      = "waste"
+	MovementAdjustment = "adjustment"
+	MovementTransfer   = "transfer"
+	MovementStocktake  = "stocktake"
+	MovementReturn     = "return"
+)
+
+const movementsCollection = "stock_movements"
+
+var (
+	ErrInvalidMovement = errors.New("invalid movement")
+	ErrItemNotFound    = errors.New("inventory item not found")
+	ErrInsufficient    = errors.New("insufficient stock")
+)
+
+// StockMovement is a single ledger entry. Quantity is signed: positive adds
+// stock, negative removes it.
+type StockMovement struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ItemID     primitive.ObjectID `json:"itemId" bson:"itemId"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Type       string             `json:"type" bson:"type"`
+	// Quantity is in the item's base unit. Callers may give it in another of
+	// the item's units by setting Unit; it is converted when recorded and the
+	// figure as entered is kept in UnitQty.
+	Quantity   float64 `json:"qty" bson:"qty"`
+	Unit       string  `json:"unit,omitempty" bson:"unit,omitempty"`
+	UnitQty    float64 `json:"unitQty,omitempty" bson:"unitQty,omitempty"`
+	User       string  `json:"user" bson:"user"`
+	Reason     string  `json:"reason" bson:"reason"`
+	Reference  string  `json:"reference,omitempty" bson:"reference,omitempty"`
+	StockAfter float64 `json:"stockAfter" bson:"stockAfter"`
+	// Batch and BestBefore open a new batch when given on a receipt. On a
+	// removal, Batch or BatchID pick which batch to take from first.
+	Batch      string             `json:"batch,omitempty" bson:"batch,omitempty"`
+	BestBefore *time.Time         `json:"bestBefore,omitempty" bson:"bestBefore,omitempty"`
+	BatchID    primitive.ObjectID `json:"batchId,omitempty" bson:"batchId,omitempty"`
+	// Batches lists the batches stock was taken from or returned to
+	Batches   []BatchUse `json:"batches,omitempty" bson:"batches,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" bson:"createdAt"`
+}
+
+// normalise applies the sign convention for the movement type. Receipts and
+// returns always add stock, sales and waste always remove it; adjustments,
+// transfers and stocktake corrections keep the sign they were given.
+func (m *StockMovement) normalise() error {
+	switch m.Type {
+	case MovementReceipt, MovementReturn:
+		if m.Quantity < 0 {
+			m.Quantity = -m.Quantity
+		}
+	case MovementSale, MovementWaste:
+		if m.Quantity > 0 {
+			m.Quantity = -m.Quantity
+		}
+	case MovementAdjustment, MovementTransfer, MovementStocktake:
+	default:
+		return ErrInvalidMovement
+	}
+	if m.Quantity == 0 || m.ItemID.IsZero() {
+		return ErrInvalidMovement
+	}
+	return nil
+}
+
+// RecordMovement applies a movement to its item's stock and appends it to the
+// ledger. The stock update is done with $inc so concurrent movements never
+// overwrite each other.
+func RecordMovement(ctx context.Context, m *StockMovement) error {
+	return recordMovement(ctx, m, false)
+}
+
+// recordMovement applies a movement; with noNegative set the update only
+// matches while enough stock remains, and ErrInsufficient is returned
+// otherwise.
+func recordMovement(ctx context.Context, m *StockMovement, noNegative bool) error {
+	if err := m.normalise(); err != nil {
+		return err
+	}
+	items, err := db.GetCollection("inventory")
+	if err != nil {
+		return err
+	}
+	movements, err := db.GetCollection(movementsCollection)
+	if err != nil {
+		return err
+	}
+	if m.Unit != "" {
+		var item InventoryItem
+		if err := items.FindOne(ctx, bson.M{"_id": m.ItemID}).Decode(&item); err == mongo.ErrNoDocuments {
+			return ErrItemNotFound
+		} else if err != nil {
+			return err
+		}
+		base, err := item.ToBase(m.Quantity, m.Unit)
+		if err != nil {
+			return err
+		}
+		m.UnitQty, m.Quantity = m.Quantity, base
+	}
+	m.ID = primitive.NewObjectID()
+	m.CreatedAt = time.Now()
+	filter := bson.M{"_id": m.ItemID}
+	if noNegative && m.Quantity < 0 {
+		filter["stock"] = bson.M{"$gte": -m.Quantity}
+	}
+	var item InventoryItem
+	err = items.FindOneAndUpdate(ctx,
+		filter,
+		bson.M{"$inc": bson.M{"stock": m.Quantity}, "$set": bson.M{"updatedAt": m.CreatedAt}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		if len(filter) > 1 {
+			return ErrInsufficient
+		}
+		return ErrItemNotFound
+	}
+	if err != nil {
+		return err
+	}
+	m.StockAfter = item.Stock
+	m.LocationID = item.LocationID
+	batches := applyBatches(ctx, m, item)
+	if _, err := movements.InsertOne(ctx, m); err != nil {
+		// Undo the stock and batch changes so neither drifts from the ledger
+		_, _ = items.UpdateOne(ctx, bson.M{"_id": m.ItemID}, bson.M{"$inc": bson.M{"stock": -m.Quantity}})
+		batches.undo(ctx)
+		return err
+	}
+	checkThreshold(ctx, item)
+	return nil
+}
+
+// ItemHistory returns the ledger for an item, newest first.
+func ItemHistory(ctx context.Context, itemID primitive.ObjectID) ([]StockMovement, error) {
+	coll, err := db.GetCollection(movementsCollection)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cur, err := coll.Find(ctx, bson.M{"itemId": itemID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	history := []StockMovement{}
+	if err := cur.All(ctx, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// hasLedger reports whether any movement is recorded for an item
+func hasLedger(ctx context.Context, itemID primitive.ObjectID) (bool, error) {
+	coll, err := db.GetCollection(movementsCollection)
+	if err != nil {
+		return false, err
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{"itemId": itemID}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// LedgerStock sums every movement recorded for an item.
+func LedgerStock(ctx context.Context, itemID primitive.ObjectID) (float64, error) {
+	coll, err := db.GetCollection(movementsCollection)
+	if err != nil {
+		return 0, err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"itemId": itemID}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$qty"}}}},
+	}
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	var result []struct {
+		Total float64 `bson:"total"`
+	}
+	if err := cur.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
@@ -0,0 +1,45 @@
+package inventory
+
+import (
+	"context"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReceiveStock books delivered goods into stock as a receipt movement and
+// folds their cost into the item's weighted average unit cost. unitCost is per
+// m.Unit (e.g. per case); the item's cost stays per its CostUnit, which an
+// item not yet costed takes from the delivery. A zero unitCost leaves the
+// cost as is.
+func ReceiveStock(ctx context.Context, m *StockMovement, unitCost money.Money) error {
+	m.Type = MovementReceipt
+	entered := m.Quantity
+	if err := RecordMovement(ctx, m); err != nil {
+		return err
+	}
+	if unitCost <= 0 {
+		return nil
+	}
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return err
+	}
+	var item InventoryItem
+	if err := coll.FindOne(ctx, bson.M{"_id": m.ItemID}).Decode(&item); err != nil {
+		return err
+	}
+	if item.CostUnit == "" && item.UnitCost == 0 {
+		item.CostUnit = m.Unit
+	}
+	// Cost per cost unit of this delivery
+	cost := unitCost.ForQty(entered*item.costFactor(), m.Quantity, money.HalfUp)
+	before := m.StockAfter - m.Quantity
+	if before > 0 && item.UnitCost > 0 {
+		cost = item.UnitCost.ForQty(before, m.StockAfter, money.HalfUp) + cost.ForQty(m.Quantity, m.StockAfter, money.HalfUp)
+	}
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": m.ItemID}, bson.M{"$set": bson.M{"unitCost": cost, "costUnit": item.CostUnit}})
+	return err
+}
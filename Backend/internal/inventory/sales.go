@@ -0,0 +1,259 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/products"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SaleLine is the part of a sale line that affects stock
+type SaleLine struct {
+	ProductID primitive.ObjectID
+	Quantity  int
+}
+
+// StockError reports which product blocked a sale
+type StockError struct {
+	Product string
+	Err     error
+}
+
+func (e *StockError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Product, e.Err)
+}
+
+func (e *StockError) Unwrap() error { return e.Err }
+
+// stockNeed is an amount of one inventory item, in its base unit
+type stockNeed struct {
+	item InventoryItem
+	qty  float64
+}
+
+// DepleteForSale records a sale movement for every tracked item used by the
+// sold products, taking stock from the selling location. Items that block
+// negative stock make the whole call fail with a *StockError, in which case
+// nothing is left decremented. Items that allow negative stock are decremented
+// anyway and reported in the returned warnings.
+func DepleteForSale(ctx context.Context, ref, user string, location primitive.ObjectID, lines []SaleLine) ([]string, error) {
+	needs, err := stockNeeds(ctx, location, lines)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	var applied []StockMovement
+	for _, need := range needs {
+		m := StockMovement{ItemID: need.item.ID, Type: MovementSale, Quantity: need.qty, User: user, Reference: ref}
+		if err := recordMovement(ctx, &m, need.item.BlockNegative); err != nil {
+			rollback(ctx, ref, user, "sale rejected", applied)
+			if err == ErrInsufficient {
+				return nil, &StockError{Product: need.item.Product, Err: err}
+			}
+			return nil, err
+		}
+		applied = append(applied, m)
+		if m.StockAfter < 0 {
+			warnings = append(warnings, fmt.Sprintf("%s stock is negative (%g %s)", need.item.Product, m.StockAfter, need.item.BaseUnit))
+		}
+	}
+	return warnings, nil
+}
+
+// RestoreForSale puts stock back for refunded or voided lines.
+func RestoreForSale(ctx context.Context, ref, user string, location primitive.ObjectID, lines []SaleLine) error {
+	needs, err := stockNeeds(ctx, location, lines)
+	if err != nil {
+		return err
+	}
+	for _, need := range needs {
+		m := StockMovement{ItemID: need.item.ID, Type: MovementReturn, Quantity: need.qty, User: user, Reference: ref}
+		if err := RecordMovement(ctx, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback reverses movements already applied by an operation that failed
+// part way
+func rollback(ctx context.Context, ref, user, reason string, applied []StockMovement) {
+	for _, a := range applied {
+		m := StockMovement{ItemID: a.ItemID, Type: MovementReturn, Quantity: -a.Quantity, Batches: a.Batches, User: user, Reference: ref, Reason: reason}
+		if err := RecordMovement(ctx, &m); err != nil {
+			log.Printf("stock rollback error for %s: %v", a.ItemID.Hex(), err)
+		}
+	}
+}
+
+// stockNeeds works out how much of each tracked item the lines use at a
+// location. Products with a recipe use its components; other products use
+// the item linked to them, one base unit per unit sold.
+func stockNeeds(ctx context.Context, location primitive.ObjectID, lines []SaleLine) ([]stockNeed, error) {
+	lines = mergeLines(lines)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+	recipes, err := productRecipes(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	linked, err := linkedItems(ctx, location, ids)
+	if err != nil {
+		return nil, err
+	}
+	var needs []stockNeed
+	index := map[primitive.ObjectID]int{}
+	add := func(item InventoryItem, qty float64) {
+		if i, ok := index[item.ID]; ok {
+			needs[i].qty = roundQty(needs[i].qty + qty)
+			return
+		}
+		index[item.ID] = len(needs)
+		needs = append(needs, stockNeed{item: item, qty: qty})
+	}
+	for _, l := range lines {
+		recipe, ok := recipes[l.ProductID]
+		if !ok {
+			if item, ok := linked[l.ProductID]; ok {
+				add(item, float64(l.Quantity))
+			}
+			continue
+		}
+		for _, component := range recipe {
+			item, ok, err := localItem(ctx, component.ItemID, location)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || item.Untracked {
+				continue
+			}
+			per, err := item.ToBase(component.Quantity, component.Unit)
+			if err != nil {
+				log.Printf("recipe for %s: %s: %v", l.ProductID.Hex(), item.Product, err)
+				continue
+			}
+			add(item, roundQty(per*float64(l.Quantity)))
+		}
+	}
+	return needs, nil
+}
+
+// productRecipes loads the recipes of the given products, keyed by product ID.
+// Products without a recipe are left out.
+func productRecipes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID][]products.RecipeLine, error) {
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		return nil, err
+	}
+	cur, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "recipe.0": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var found []products.Product
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	result := map[primitive.ObjectID][]products.RecipeLine{}
+	for _, p := range found {
+		result[p.ID] = p.Recipe
+	}
+	return result, nil
+}
+
+// linkedItems loads the tracked inventory items linked to the given products
+// at a location, keyed by product ID. A location's own item wins over shared
+// stock.
+func linkedItems(ctx context.Context, location primitive.ObjectID, ids []primitive.ObjectID) (map[primitive.ObjectID]InventoryItem, error) {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return nil, err
+	}
+	locations := bson.A{nil}
+	if !location.IsZero() {
+		locations = append(locations, location)
+	}
+	filter := bson.M{
+		"productId":  bson.M{"$in": ids},
+		"locationId": bson.M{"$in": locations},
+		"untracked":  bson.M{"$ne": true},
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var found []InventoryItem
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	result := map[primitive.ObjectID]InventoryItem{}
+	for _, item := range found {
+		if _, ok := result[item.ProductID]; ok && item.LocationID.IsZero() {
+			continue
+		}
+		result[item.ProductID] = item
+	}
+	return result, nil
+}
+
+// localItem resolves an item referenced by a recipe to the equivalent item at
+// a location (same product link, or same name when unlinked). Shared stock is
+// used when the location has no item of its own; another site's stock never is.
+func localItem(ctx context.Context, itemID, location primitive.ObjectID) (InventoryItem, bool, error) {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return InventoryItem{}, false, err
+	}
+	var ref InventoryItem
+	if err := coll.FindOne(ctx, bson.M{"_id": itemID}).Decode(&ref); err == mongo.ErrNoDocuments {
+		return InventoryItem{}, false, nil
+	} else if err != nil {
+		return InventoryItem{}, false, err
+	}
+	if location.IsZero() || ref.LocationID == location {
+		return ref, true, nil
+	}
+	filter := bson.M{"locationId": location, "product": ref.Product}
+	if !ref.ProductID.IsZero() {
+		filter = bson.M{"locationId": location, "productId": ref.ProductID}
+	}
+	var local InventoryItem
+	err = coll.FindOne(ctx, filter).Decode(&local)
+	if err == nil {
+		return local, true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return InventoryItem{}, false, err
+	}
+	return ref, ref.LocationID.IsZero(), nil
+}
+
+// mergeLines sums quantities for products that appear on several lines
+func mergeLines(lines []SaleLine) []SaleLine {
+	var merged []SaleLine
+	index := map[primitive.ObjectID]int{}
+	for _, l := range lines {
+		if l.ProductID.IsZero() || l.Quantity <= 0 {
+			continue
+		}
+		if i, ok := index[l.ProductID]; ok {
+			merged[i].Quantity += l.Quantity
+			continue
+		}
+		index[l.ProductID] = len(merged)
+		merged = append(merged, l)
+	}
+	return merged
+}
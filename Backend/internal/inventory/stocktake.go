@@ -0,0 +1,473 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stocktake states
+const (
+	StocktakeOpen = "open"
+	// StocktakeFinalising is held while the adjustments are posted; a
+	// session left in it by a failure can be finalised again
+	StocktakeFinalising = "finalising"
+	StocktakeFinalised  = "finalised"
+)
+
+const stocktakesCollection = "stocktakes"
+
+// StocktakeLine is an item's expected stock when the session was opened
+type StocktakeLine struct {
+	ItemID   primitive.ObjectID `json:"itemId" bson:"itemId"`
+	Product  string             `json:"product" bson:"product"`
+	Expected float64            `json:"expected" bson:"expected"`
+	BaseUnit string             `json:"baseUnit" bson:"baseUnit"`
+	// UnitCost is the item's cost when the session was opened, for CostPer
+	// base units (one when unset)
+	UnitCost money.Money `json:"unitCost" bson:"unitCost"`
+	CostPer  float64     `json:"costPer,omitempty" bson:"costPer,omitempty"`
+}
+
+// costOf values qty base units at the line's unit cost
+func (l StocktakeLine) costOf(qty float64) money.Money {
+	per := l.CostPer
+	if per <= 0 {
+		per = 1
+	}
+	return l.UnitCost.ForQty(qty, per, money.HalfUp)
+}
+
+// StocktakeCount is one person's count of an item in one area. A later count
+// for the same item and area replaces the earlier one. Counts may be given in
+// any of the item's units; Quantity is stored in the base unit.
+type StocktakeCount struct {
+	ItemID    primitive.ObjectID `json:"itemId" bson:"itemId"`
+	Area      string             `json:"area" bson:"area"`
+	Quantity  float64            `json:"qty" bson:"qty"`
+	Unit      string             `json:"unit,omitempty" bson:"unit,omitempty"`
+	UnitQty   float64            `json:"unitQty,omitempty" bson:"unitQty,omitempty"`
+	User      string             `json:"user" bson:"user"`
+	CountedAt time.Time          `json:"countedAt" bson:"countedAt"`
+}
+
+type Stocktake struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	LocationID  primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Status      string             `json:"status" bson:"status"`
+	Lines       []StocktakeLine    `json:"lines" bson:"lines"`
+	Counts      []StocktakeCount   `json:"counts" bson:"counts"`
+	CreatedBy   string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	FinalisedBy string             `json:"finalisedBy,omitempty" bson:"finalisedBy,omitempty"`
+	FinalisedAt *time.Time         `json:"finalisedAt,omitempty" bson:"finalisedAt,omitempty"`
+}
+
+// VarianceLine compares counted against expected stock for one item
+type VarianceLine struct {
+	ItemID   primitive.ObjectID `json:"itemId"`
+	Product  string             `json:"product"`
+	BaseUnit string             `json:"baseUnit"`
+	Expected float64            `json:"expected"`
+	Counted  float64            `json:"counted"`
+	Variance float64            `json:"variance"`
+	Cost     money.Money        `json:"cost"`
+	Areas    map[string]float64 `json:"areas"`
+}
+
+type VarianceReport struct {
+	StocktakeID   primitive.ObjectID `json:"stocktakeId"`
+	Status        string             `json:"status"`
+	Lines         []VarianceLine     `json:"lines"`
+	Uncounted     []StocktakeLine    `json:"uncounted"`
+	TotalVariance float64            `json:"totalVariance"`
+	TotalCost     money.Money        `json:"totalCost"`
+}
+
+// Variance builds the report. Only counted items are compared; items nobody
+// counted are listed separately rather than treated as zero.
+func (st *Stocktake) Variance() VarianceReport {
+	areas := map[primitive.ObjectID]map[string]float64{}
+	for _, c := range st.Counts {
+		if areas[c.ItemID] == nil {
+			areas[c.ItemID] = map[string]float64{}
+		}
+		areas[c.ItemID][c.Area] = c.Quantity
+	}
+	report := VarianceReport{StocktakeID: st.ID, Status: st.Status, Lines: []VarianceLine{}, Uncounted: []StocktakeLine{}}
+	for _, l := range st.Lines {
+		counts, ok := areas[l.ItemID]
+		if !ok {
+			report.Uncounted = append(report.Uncounted, l)
+			continue
+		}
+		counted := 0.0
+		for _, q := range counts {
+			counted += q
+		}
+		counted = roundQty(counted)
+		v := VarianceLine{
+			ItemID:   l.ItemID,
+			Product:  l.Product,
+			BaseUnit: l.BaseUnit,
+			Expected: l.Expected,
+			Counted:  counted,
+			Variance: roundQty(counted - l.Expected),
+			Cost:     l.costOf(counted - l.Expected),
+			Areas:    counts,
+		}
+		report.Lines = append(report.Lines, v)
+		report.TotalVariance += v.Variance
+		report.TotalCost += v.Cost
+	}
+	return report
+}
+
+// StocktakesHandler handles /api/stocktakes and its sub-routes
+func StocktakesHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(stocktakesCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) >= 3 && parts[2] != "" {
+		id, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		var st Stocktake
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&st); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		action := ""
+		if len(parts) > 3 {
+			action = parts[3]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(st)
+		case action == "counts" && r.Method == http.MethodPost:
+			submitCounts(ctx, w, r, &st)
+		case action == "variance" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(st.Variance())
+		case action == "finalise" && r.Method == http.MethodPost:
+			finaliseStocktake(ctx, w, r, &st)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filter["status"] = status
+		}
+		if loc, ok := locationParam(r); ok {
+			filter["locationId"] = loc
+		}
+		// Lines and counts can be large; the list only needs the headers
+		opts := options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+			SetProjection(bson.M{"lines": 0, "counts": 0})
+		cur, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		sessions := []Stocktake{}
+		if err := cur.All(ctx, &sessions); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	case http.MethodPost:
+		var st Stocktake
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		lines, err := snapshot(ctx, st.LocationID)
+		if err != nil {
+			log.Printf("snapshot error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		st.ID = primitive.NewObjectID()
+		st.Status = StocktakeOpen
+		st.Lines = lines
+		st.Counts = []StocktakeCount{}
+		st.CreatedAt = time.Now()
+		st.CreatedBy = requestUserName(ctx, r)
+		st.FinalisedBy, st.FinalisedAt = "", nil
+		if _, err := coll.InsertOne(ctx, st); err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(st)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshot records the expected stock of every tracked item, limited to one
+// location's items when a location is given
+func snapshot(ctx context.Context, location primitive.ObjectID) ([]StocktakeLine, error) {
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"untracked": bson.M{"$ne": true}}
+	if !location.IsZero() {
+		filter["locationId"] = location
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var items []InventoryItem
+	if err := cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	lines := make([]StocktakeLine, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, StocktakeLine{ItemID: item.ID, Product: item.Product, Expected: item.Stock, BaseUnit: item.BaseUnit, UnitCost: item.UnitCost, CostPer: item.costFactor()})
+	}
+	return lines, nil
+}
+
+// submitCounts handles POST /api/stocktakes/{id}/counts. The body is a list
+// of counts; each replaces any earlier count for the same item and area.
+func submitCounts(ctx context.Context, w http.ResponseWriter, r *http.Request, st *Stocktake) {
+	var counts []StocktakeCount
+	if err := json.NewDecoder(r.Body).Decode(&counts); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	known := map[primitive.ObjectID]bool{}
+	for _, l := range st.Lines {
+		known[l.ItemID] = true
+	}
+	items, err := db.GetCollection("inventory")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	user := requestUserName(ctx, r)
+	now := time.Now()
+	for i := range counts {
+		c := &counts[i]
+		if !known[c.ItemID] || c.Quantity < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unknown item or negative qty"}`))
+			return
+		}
+		if c.Unit != "" {
+			var item InventoryItem
+			if err := items.FindOne(ctx, bson.M{"_id": c.ItemID}).Decode(&item); err != nil {
+				log.Printf("find error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			base, err := item.ToBase(c.Quantity, c.Unit)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"unknown unit"}`))
+				return
+			}
+			c.UnitQty, c.Quantity = c.Quantity, base
+		}
+		if user != "" {
+			c.User = user
+		}
+		c.CountedAt = now
+	}
+	coll, err := db.GetCollection(stocktakesCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	for _, c := range counts {
+		// Drop the previous count for this item and area, then add the new one
+		filter := bson.M{"_id": st.ID, "status": StocktakeOpen}
+		pull := bson.M{"$pull": bson.M{"counts": bson.M{"itemId": c.ItemID, "area": c.Area}}}
+		if _, err := coll.UpdateOne(ctx, filter, pull); err != nil {
+			log.Printf("count error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		res, err := coll.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"counts": c}})
+		if err != nil {
+			log.Printf("count error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.MatchedCount == 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"stocktake is finalised"}`))
+			return
+		}
+	}
+	var updated Stocktake
+	if err := coll.FindOne(ctx, bson.M{"_id": st.ID}).Decode(&updated); err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated.Variance())
+}
+
+// finaliseStocktake handles POST /api/stocktakes/{id}/finalise. A manager
+// approves it with their PIN, as for refunds, since it changes the books.
+func finaliseStocktake(ctx context.Context, w http.ResponseWriter, r *http.Request, st *Stocktake) {
+	var req struct {
+		ApproverName string `json:"approverName"`
+		ApproverPin  string `json:"approverPin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	approver, err := users.ManagerApproval(ctx, r, req.ApproverName, req.ApproverPin)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"manager approval required"}`))
+		return
+	}
+	var done *Stocktake
+	if db.SupportsTransactions(ctx) {
+		// Low-stock alerts wait for the commit, as for a sale
+		var alerts *PendingAlerts
+		err = db.WithTransaction(ctx, func(tx context.Context) error {
+			tx, alerts = DeferAlerts(tx)
+			done, err = finalise(tx, st.ID, approver.Name)
+			return err
+		})
+		if err == nil {
+			alerts.Send()
+		}
+	} else {
+		done, err = finalise(ctx, st.ID, approver.Name)
+	}
+	if err == errFinalised {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"stocktake is already finalised"}`))
+		return
+	} else if err != nil {
+		log.Printf("stocktake %s: finalise failed: %v", st.ID.Hex(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"stocktake adjustments failed; finalise again to retry"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(done.Variance())
+}
+
+var errFinalised = errors.New("stocktake is already finalised")
+
+// finalise posts a stocktake movement for every counted item that differs
+// from its expected stock, then marks the session finalised. The session is
+// held as finalising meanwhile so no more counts come in; if posting fails
+// part way it stays finalising, and finalising again posts only what is
+// missing.
+func finalise(ctx context.Context, id primitive.ObjectID, user string) (*Stocktake, error) {
+	coll, err := db.GetCollection(stocktakesCollection)
+	if err != nil {
+		return nil, err
+	}
+	var st Stocktake
+	err = coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": bson.A{StocktakeOpen, StocktakeFinalising}}},
+		bson.M{"$set": bson.M{"status": StocktakeFinalising}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&st)
+	if err == mongo.ErrNoDocuments {
+		return nil, errFinalised
+	} else if err != nil {
+		return nil, err
+	}
+	movements, err := db.GetCollection(movementsCollection)
+	if err != nil {
+		return nil, err
+	}
+	posted, err := movements.Distinct(ctx, "itemId", bson.M{"type": MovementStocktake, "reference": st.ID.Hex()})
+	if err != nil {
+		return nil, err
+	}
+	done := map[primitive.ObjectID]bool{}
+	for _, v := range posted {
+		if itemID, ok := v.(primitive.ObjectID); ok {
+			done[itemID] = true
+		}
+	}
+	for _, l := range st.Variance().Lines {
+		if l.Variance == 0 || done[l.ItemID] {
+			continue
+		}
+		m := StockMovement{ItemID: l.ItemID, Type: MovementStocktake, Quantity: l.Variance, User: user, Reason: st.Name, Reference: st.ID.Hex()}
+		if err := RecordMovement(ctx, &m); err != nil {
+			return nil, fmt.Errorf("adjustment for %s: %w", l.ItemID.Hex(), err)
+		}
+	}
+	now := time.Now()
+	err = coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": st.ID, "status": StocktakeFinalising},
+		bson.M{"$set": bson.M{"status": StocktakeFinalised, "finalisedBy": user, "finalisedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&st)
+	if err == mongo.ErrNoDocuments {
+		return nil, errFinalised
+	} else if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
@@ -0,0 +1,346 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Transfer states. Stock leaves the source when a transfer is sent and
+// arrives at the destination when it is received; in between it is in transit
+// and counted at neither site.
+const (
+	TransferDraft     = "draft"
+	TransferInTransit = "in_transit"
+	TransferReceived  = "received"
+)
+
+const transfersCollection = "stock_transfers"
+
+type TransferLine struct {
+	// ItemID is the source location's item
+	ItemID primitive.ObjectID `json:"itemId" bson:"itemId"`
+	// DestItemID is filled in on receipt
+	DestItemID primitive.ObjectID `json:"destItemId,omitempty" bson:"destItemId,omitempty"`
+	Product    string             `json:"product" bson:"product"`
+	Quantity   float64            `json:"qty" bson:"qty"` // base unit
+	// Batches records which batches were sent so they arrive with the stock
+	Batches []BatchUse `json:"batches,omitempty" bson:"batches,omitempty"`
+}
+
+type Transfer struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	FromLocation primitive.ObjectID `json:"fromLocationId" bson:"fromLocationId"`
+	ToLocation   primitive.ObjectID `json:"toLocationId" bson:"toLocationId"`
+	Status       string             `json:"status" bson:"status"`
+	Lines        []TransferLine     `json:"lines" bson:"lines"`
+	Notes        string             `json:"notes" bson:"notes"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+	SentBy       string             `json:"sentBy,omitempty" bson:"sentBy,omitempty"`
+	SentAt       *time.Time         `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+	ReceivedBy   string             `json:"receivedBy,omitempty" bson:"receivedBy,omitempty"`
+	ReceivedAt   *time.Time         `json:"receivedAt,omitempty" bson:"receivedAt,omitempty"`
+}
+
+// TransfersHandler handles /api/stock-transfers and its sub-routes
+func TransfersHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(transfersCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) >= 3 && parts[2] != "" {
+		id, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		var t Transfer
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&t); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		action := ""
+		if len(parts) > 3 {
+			action = parts[3]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t)
+		case action == "send" && r.Method == http.MethodPost:
+			sendTransfer(ctx, w, r, &t)
+		case action == "receive" && r.Method == http.MethodPost:
+			receiveTransfer(ctx, w, r, &t)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filter["status"] = status
+		}
+		if loc, ok := locationParam(r); ok {
+			filter["$or"] = bson.A{bson.M{"fromLocationId": loc}, bson.M{"toLocationId": loc}}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+		cur, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		transfers := []Transfer{}
+		if err := cur.All(ctx, &transfers); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(transfers)
+	case http.MethodPost:
+		var t Transfer
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		if t.FromLocation.IsZero() || t.ToLocation.IsZero() || t.FromLocation == t.ToLocation {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"two different locations required"}`))
+			return
+		}
+		if len(t.Lines) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"transfer has no lines"}`))
+			return
+		}
+		items, err := db.GetCollection("inventory")
+		if err != nil {
+			log.Printf("db error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		for i := range t.Lines {
+			l := &t.Lines[i]
+			var item InventoryItem
+			err := items.FindOne(ctx, bson.M{"_id": l.ItemID, "locationId": t.FromLocation}).Decode(&item)
+			if err != nil || l.Quantity <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"each line needs a source-location item and a positive qty"}`))
+				return
+			}
+			l.Product = item.Product
+			l.DestItemID = primitive.NilObjectID
+			l.Batches = nil
+		}
+		t.ID = primitive.NewObjectID()
+		t.Status = TransferDraft
+		t.CreatedAt = time.Now()
+		t.SentBy, t.SentAt, t.ReceivedBy, t.ReceivedAt = "", nil, "", nil
+		if _, err := coll.InsertOne(ctx, t); err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// requestUserName returns the logged-in user's name, or "" when anonymous
+func requestUserName(ctx context.Context, r *http.Request) string {
+	if u, err := users.FromRequest(ctx, r); err == nil {
+		return u.Name
+	}
+	return ""
+}
+
+// sendTransfer takes the stock out of the source location. Transfers never
+// take a source below zero.
+func sendTransfer(ctx context.Context, w http.ResponseWriter, r *http.Request, t *Transfer) {
+	coll, err := db.GetCollection(transfersCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	user := requestUserName(ctx, r)
+	now := time.Now()
+	// Claim the transfer so it cannot be sent twice
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": t.ID, "status": TransferDraft},
+		bson.M{"$set": bson.M{"status": TransferInTransit, "sentBy": user, "sentAt": now}})
+	if err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if res.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"only draft transfers can be sent"}`))
+		return
+	}
+	var applied []StockMovement
+	for i := range t.Lines {
+		l := &t.Lines[i]
+		m := StockMovement{ItemID: l.ItemID, Type: MovementTransfer, Quantity: -l.Quantity, User: user, Reference: t.ID.Hex(), Reason: "transfer out"}
+		if err := recordMovement(ctx, &m, true); err != nil {
+			// Put back what was already taken and return the transfer to draft
+			for _, a := range applied {
+				back := StockMovement{ItemID: a.ItemID, Type: MovementTransfer, Quantity: -a.Quantity, Batches: a.Batches, User: user, Reference: t.ID.Hex(), Reason: "transfer cancelled"}
+				if err := RecordMovement(ctx, &back); err != nil {
+					log.Printf("transfer %s: rollback for %s failed: %v", t.ID.Hex(), a.ItemID.Hex(), err)
+				}
+			}
+			coll.UpdateOne(ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"status": TransferDraft}, "$unset": bson.M{"sentBy": "", "sentAt": ""}})
+			if err == ErrInsufficient {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"error": "insufficient stock", "product": l.Product})
+				return
+			}
+			log.Printf("transfer error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"stock error"}`))
+			return
+		}
+		applied = append(applied, m)
+		l.Batches = m.Batches
+	}
+	coll.UpdateOne(ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"lines": t.Lines}})
+	t.Status, t.SentBy, t.SentAt = TransferInTransit, user, &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// receiveTransfer books the stock into the destination. The destination item
+// for each product is created from the source item if the site has none yet.
+func receiveTransfer(ctx context.Context, w http.ResponseWriter, r *http.Request, t *Transfer) {
+	coll, err := db.GetCollection(transfersCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	user := requestUserName(ctx, r)
+	now := time.Now()
+	// Claim the transfer so it cannot be received twice
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": t.ID, "status": TransferInTransit},
+		bson.M{"$set": bson.M{"status": TransferReceived, "receivedBy": user, "receivedAt": now}})
+	if err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if res.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"transfer is not in transit"}`))
+		return
+	}
+	var applied []StockMovement
+	for i := range t.Lines {
+		l := &t.Lines[i]
+		dest, err := destinationItem(ctx, l.ItemID, t.ToLocation)
+		if err == nil {
+			m := StockMovement{ItemID: dest, Type: MovementTransfer, Quantity: l.Quantity, Batches: l.Batches, User: user, Reference: t.ID.Hex(), Reason: "transfer in"}
+			if err = RecordMovement(ctx, &m); err == nil {
+				applied = append(applied, m)
+				l.DestItemID = dest
+				l.Batches = m.Batches
+				continue
+			}
+		}
+		log.Printf("transfer %s: receive for %s failed: %v", t.ID.Hex(), l.ItemID.Hex(), err)
+		// Take back what was already booked in and leave the transfer in
+		// transit, so it can be received again
+		for _, a := range applied {
+			back := StockMovement{ItemID: a.ItemID, Type: MovementTransfer, Quantity: -a.Quantity, User: user, Reference: t.ID.Hex(), Reason: "transfer receipt cancelled"}
+			if len(a.Batches) > 0 {
+				back.BatchID = a.Batches[0].BatchID
+			}
+			if err := RecordMovement(ctx, &back); err != nil {
+				log.Printf("transfer %s: rollback for %s failed: %v", t.ID.Hex(), a.ItemID.Hex(), err)
+			}
+		}
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"status": TransferInTransit}, "$unset": bson.M{"receivedBy": "", "receivedAt": ""}}); err != nil {
+			log.Printf("transfer %s: reset to in transit failed: %v", t.ID.Hex(), err)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"stock error"}`))
+		return
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"lines": t.Lines}}); err != nil {
+		// The stock is booked; only the line details are missing
+		log.Printf("transfer %s: saving received lines failed: %v", t.ID.Hex(), err)
+	}
+	t.Status, t.ReceivedBy, t.ReceivedAt = TransferReceived, user, &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// destinationItem finds the item at a location that matches a source item,
+// creating it with the source's settings and no stock if needed
+func destinationItem(ctx context.Context, sourceID, location primitive.ObjectID) (primitive.ObjectID, error) {
+	items, err := db.GetCollection("inventory")
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	var src InventoryItem
+	if err := items.FindOne(ctx, bson.M{"_id": sourceID}).Decode(&src); err != nil {
+		return primitive.NilObjectID, err
+	}
+	filter := bson.M{"locationId": location, "product": src.Product}
+	if !src.ProductID.IsZero() {
+		filter = bson.M{"locationId": location, "productId": src.ProductID}
+	}
+	var dest InventoryItem
+	err = items.FindOne(ctx, filter).Decode(&dest)
+	if err == nil {
+		return dest.ID, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return primitive.NilObjectID, err
+	}
+	dest = src
+	dest.ID = primitive.NewObjectID()
+	dest.LocationID = location
+	dest.Stock = 0
+	dest.Alerted = false
+	dest.UpdatedAt = time.Now()
+	if _, err := items.InsertOne(ctx, dest); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return dest.ID, nil
+}
@@ -0,0 +1,59 @@
+package inventory
+
+import (
+	"errors"
+	"math"
+
+	"hospos-backend/internal/money"
+)
+
+var ErrUnknownUnit = errors.New("unknown unit")
+
+// UnitConversion defines a unit as a multiple of the item's base unit, e.g.
+// with a base unit of "bottle", a "case" might be 12 and a "glass" 0.2333.
+type UnitConversion struct {
+	Name   string  `json:"name" bson:"name"`
+	Factor float64 `json:"factor" bson:"factor"`
+}
+
+// UnitFactor returns how many base units one of the named unit holds. The
+// base unit itself, or an empty name, is 1.
+func (item *InventoryItem) UnitFactor(unit string) (float64, error) {
+	if unit == "" || unit == item.BaseUnit {
+		return 1, nil
+	}
+	for _, u := range item.Units {
+		if u.Name == unit && u.Factor > 0 {
+			return u.Factor, nil
+		}
+	}
+	return 0, ErrUnknownUnit
+}
+
+// ToBase converts a quantity in the named unit to the item's base unit
+func (item *InventoryItem) ToBase(qty float64, unit string) (float64, error) {
+	factor, err := item.UnitFactor(unit)
+	if err != nil {
+		return 0, err
+	}
+	return roundQty(qty * factor), nil
+}
+
+// costFactor is the number of base units the item's UnitCost is for
+func (item *InventoryItem) costFactor() float64 {
+	factor, err := item.UnitFactor(item.CostUnit)
+	if err != nil {
+		return 1
+	}
+	return factor
+}
+
+// CostOf values qty of the item's base unit at its unit cost
+func (item *InventoryItem) CostOf(qty float64) money.Money {
+	return item.UnitCost.ForQty(qty, item.costFactor(), money.HalfUp)
+}
+
+// roundQty trims floating point noise from converted quantities
+func roundQty(q float64) float64 {
+	return math.Round(q*1e6) / 1e6
+}
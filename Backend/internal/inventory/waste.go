@@ -0,0 +1,367 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/business"
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/products"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Waste reason codes
+const (
+	WasteSpoiled   = "spoiled"
+	WasteDropped   = "dropped"
+	WasteComp      = "comp"
+	WasteStaffMeal = "staff_meal"
+)
+
+const wasteCollection = "waste"
+
+var ErrInvalidWaste = errors.New("invalid waste record")
+
+func validWasteReason(reason string) bool {
+	switch reason {
+	case WasteSpoiled, WasteDropped, WasteComp, WasteStaffMeal:
+		return true
+	}
+	return false
+}
+
+// WasteRecord is one logged loss: either an inventory item directly (a spilt
+// bottle) or a menu product, whose recipe or linked item is taken out of stock
+// (a dropped plate). Cost is the stock value lost at the items' unit cost, in
+// Currency.
+type WasteRecord struct {
+	ID         primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	ItemID     primitive.ObjectID   `json:"itemId,omitempty" bson:"itemId,omitempty"`
+	ProductID  primitive.ObjectID   `json:"productId,omitempty" bson:"productId,omitempty"`
+	BatchID    primitive.ObjectID   `json:"batchId,omitempty" bson:"batchId,omitempty"`
+	Product    string               `json:"product" bson:"product"`
+	Quantity   float64              `json:"qty" bson:"qty"`
+	Unit       string               `json:"unit,omitempty" bson:"unit,omitempty"`
+	Reason     string               `json:"reason" bson:"reason"`
+	Note       string               `json:"note,omitempty" bson:"note,omitempty"`
+	User       string               `json:"user" bson:"user"`
+	LocationID primitive.ObjectID   `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Cost       money.Money          `json:"cost" bson:"cost"`
+	Currency   string               `json:"currency" bson:"currency"`
+	Movements  []primitive.ObjectID `json:"movements" bson:"movements"`
+	CreatedAt  time.Time            `json:"createdAt" bson:"createdAt"`
+}
+
+// WasteTotal is a row of the waste report
+type WasteTotal struct {
+	Key      string      `json:"key" bson:"_id"`
+	Count    int         `json:"count" bson:"count"`
+	Quantity float64     `json:"qty" bson:"qty"`
+	Cost     money.Money `json:"cost" bson:"cost"`
+}
+
+// WasteReport sums waste over a period by reason and by product
+type WasteReport struct {
+	From      *time.Time   `json:"from,omitempty"`
+	To        *time.Time   `json:"to,omitempty"`
+	Count     int          `json:"count"`
+	TotalCost money.Money  `json:"totalCost"`
+	Currency  string       `json:"currency"`
+	ByReason  []WasteTotal `json:"byReason"`
+	ByProduct []WasteTotal `json:"byProduct"`
+}
+
+// LogWaste takes the wasted stock out of inventory with waste movements and
+// stores the record with its cost.
+func LogWaste(ctx context.Context, rec *WasteRecord) error {
+	if !validWasteReason(rec.Reason) || rec.Quantity <= 0 || rec.ItemID.IsZero() == rec.ProductID.IsZero() {
+		return ErrInvalidWaste
+	}
+	coll, err := db.GetCollection(wasteCollection)
+	if err != nil {
+		return err
+	}
+	rec.ID = primitive.NewObjectID()
+	rec.CreatedAt = time.Now()
+	rec.Cost = 0
+	rec.Currency = business.Currency(ctx)
+	rec.Movements = []primitive.ObjectID{}
+	var needs []stockNeed
+	if !rec.ItemID.IsZero() {
+		item, err := findItem(ctx, rec.ItemID)
+		if err != nil {
+			return err
+		}
+		qty, err := item.ToBase(rec.Quantity, rec.Unit)
+		if err != nil {
+			return err
+		}
+		rec.Product = item.Product
+		rec.LocationID = item.LocationID
+		needs = []stockNeed{{item: item, qty: qty}}
+	} else {
+		p, err := findProduct(ctx, rec.ProductID)
+		if err != nil {
+			return err
+		}
+		rec.Product = p.Name
+		rec.Unit = ""
+		// Recipes are per unit sold, so work out one and scale it
+		perUnit, err := stockNeeds(ctx, rec.LocationID, []SaleLine{{ProductID: rec.ProductID, Quantity: 1}})
+		if err != nil {
+			return err
+		}
+		for _, n := range perUnit {
+			needs = append(needs, stockNeed{item: n.item, qty: roundQty(n.qty * rec.Quantity)})
+		}
+	}
+	var applied []StockMovement
+	for _, n := range needs {
+		m := StockMovement{
+			ItemID:    n.item.ID,
+			Type:      MovementWaste,
+			Quantity:  n.qty,
+			BatchID:   rec.BatchID,
+			User:      rec.User,
+			Reason:    rec.Reason,
+			Reference: rec.ID.Hex(),
+		}
+		if err := RecordMovement(ctx, &m); err != nil {
+			rollback(ctx, rec.ID.Hex(), rec.User, "waste not logged", applied)
+			return err
+		}
+		applied = append(applied, m)
+		rec.Movements = append(rec.Movements, m.ID)
+		rec.Cost += n.item.CostOf(-m.Quantity)
+	}
+	if _, err := coll.InsertOne(ctx, rec); err != nil {
+		rollback(ctx, rec.ID.Hex(), rec.User, "waste not logged", applied)
+		return err
+	}
+	return nil
+}
+
+func findItem(ctx context.Context, id primitive.ObjectID) (InventoryItem, error) {
+	var item InventoryItem
+	coll, err := db.GetCollection("inventory")
+	if err != nil {
+		return item, err
+	}
+	err = coll.FindOne(ctx, bson.M{"_id": id}).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return item, ErrItemNotFound
+	}
+	return item, err
+}
+
+func findProduct(ctx context.Context, id primitive.ObjectID) (products.Product, error) {
+	var p products.Product
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		return p, err
+	}
+	err = coll.FindOne(ctx, bson.M{"_id": id}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return p, ErrItemNotFound
+	}
+	return p, err
+}
+
+// wasteFilter builds the filter shared by the waste list and report
+func wasteFilter(location primitive.ObjectID, from, to *time.Time) bson.M {
+	filter := bson.M{}
+	if !location.IsZero() {
+		filter["locationId"] = location
+	}
+	created := bson.M{}
+	if from != nil {
+		created["$gte"] = *from
+	}
+	if to != nil {
+		created["$lt"] = *to
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+	return filter
+}
+
+// Waste sums waste records by reason and by product, optionally for one
+// location and between from (inclusive) and to (exclusive).
+func Waste(ctx context.Context, location primitive.ObjectID, from, to *time.Time) (*WasteReport, error) {
+	coll, err := db.GetCollection(wasteCollection)
+	if err != nil {
+		return nil, err
+	}
+	report := &WasteReport{From: from, To: to, Currency: business.Currency(ctx)}
+	match := wasteFilter(location, from, to)
+	group := func(key string) ([]WasteTotal, error) {
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: match}},
+			{{Key: "$group", Value: bson.M{
+				"_id":   "$" + key,
+				"count": bson.M{"$sum": 1},
+				"qty":   bson.M{"$sum": "$qty"},
+				"cost":  bson.M{"$sum": "$cost"},
+			}}},
+			{{Key: "$sort", Value: bson.M{"cost": -1}}},
+		}
+		cur, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		defer cur.Close(ctx)
+		totals := []WasteTotal{}
+		err = cur.All(ctx, &totals)
+		return totals, err
+	}
+	if report.ByReason, err = group("reason"); err != nil {
+		return nil, err
+	}
+	if report.ByProduct, err = group("product"); err != nil {
+		return nil, err
+	}
+	for _, t := range report.ByReason {
+		report.Count += t.Count
+		report.TotalCost += t.Cost
+	}
+	return report, nil
+}
+
+// WasteHandler handles /api/waste and /api/waste/report
+func WasteHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(wasteCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	loc, _ := locationParam(r)
+	from, to, ok := periodParams(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid from or to date"}`))
+		return
+	}
+	if len(parts) == 3 && parts[2] == "report" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := Waste(ctx, loc, from, to)
+		if err != nil {
+			log.Printf("waste report error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	if len(parts) >= 3 && parts[2] != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		filter := wasteFilter(loc, from, to)
+		if reason := r.URL.Query().Get("reason"); reason != "" {
+			filter["reason"] = reason
+		}
+		cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		records := []WasteRecord{}
+		if err := cur.All(ctx, &records); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	case http.MethodPost:
+		var rec WasteRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		if name := requestUserName(ctx, r); name != "" {
+			rec.User = name
+		}
+		// A linked till's ID is its location's ID
+		if rec.LocationID.IsZero() {
+			if loc, err := primitive.ObjectIDFromHex(r.Header.Get("X-Till-ID")); err == nil {
+				rec.LocationID = loc
+			}
+		}
+		rec.BatchID = primitive.NilObjectID
+		if err := LogWaste(ctx, &rec); err != nil {
+			switch err {
+			case ErrInvalidWaste:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"need itemId or productId, a positive qty and a reason of spoiled, dropped, comp or staff_meal"}`))
+			case ErrUnknownUnit:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"unknown unit"}`))
+			case ErrItemNotFound:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+			default:
+				log.Printf("waste error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+			}
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rec)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// periodParams reads the optional ?from= and ?to= query parameters, given as
+// dates (2006-01-02) or RFC 3339 times. A bare to date includes that whole day.
+func periodParams(r *http.Request) (from, to *time.Time, ok bool) {
+	parse := func(s string, end bool) (*time.Time, bool) {
+		if s == "" {
+			return nil, true
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return &t, true
+		}
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return nil, false
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, true
+	}
+	q := r.URL.Query()
+	from, okFrom := parse(q.Get("from"), false)
+	to, okTo := parse(q.Get("to"), true)
+	return from, to, okFrom && okTo
+}
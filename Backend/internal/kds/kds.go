@@ -0,0 +1,489 @@
+// Package kds sends ordered items to kitchen display stations as tickets and
+// tracks them from new through to served.
+package kds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ticketsCollection = "kds_tickets"
+
+// Ticket and item statuses, in the order they move through the kitchen
+const (
+	StatusNew       = "new"
+	StatusPreparing = "preparing"
+	StatusReady     = "ready"
+	StatusServed    = "served"
+)
+
+var statusOrder = []string{StatusNew, StatusPreparing, StatusReady, StatusServed}
+
+func rank(status string) int {
+	for i, s := range statusOrder {
+		if s == status {
+			return i
+		}
+	}
+	return -1
+}
+
+// Where a ticket's items were ordered
+const (
+	SourceSale = "sale"
+	SourceTab  = "tab"
+)
+
+// TicketItem is one line on a ticket. Its times are set when it first
+// reaches each status.
+type TicketItem struct {
+	ID        primitive.ObjectID `json:"id" bson:"id"`
+	LineID    primitive.ObjectID `json:"lineId,omitempty" bson:"lineId,omitempty"`
+	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
+	Name      string             `json:"name" bson:"name"`
+	Quantity  int                `json:"qty" bson:"qty"`
+	Modifiers []string           `json:"modifiers,omitempty" bson:"modifiers,omitempty"`
+	Note      string             `json:"note,omitempty" bson:"note,omitempty"`
+	Seat      int                `json:"seat,omitempty" bson:"seat,omitempty"`
+	Course    int                `json:"course,omitempty" bson:"course,omitempty"`
+	Status    string             `json:"status" bson:"status"`
+	StartedAt *time.Time         `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	ReadyAt   *time.Time         `json:"readyAt,omitempty" bson:"readyAt,omitempty"`
+	ServedAt  *time.Time         `json:"servedAt,omitempty" bson:"servedAt,omitempty"`
+}
+
+// Ticket is the items of one order sent to one station. Its status is that
+// of its least advanced item.
+type Ticket struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	StationID   primitive.ObjectID `json:"stationId" bson:"stationId"`
+	StationName string             `json:"stationName" bson:"stationName"`
+	LocationID  primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Source      string             `json:"source" bson:"source"`
+	SaleID      primitive.ObjectID `json:"saleId,omitempty" bson:"saleId,omitempty"`
+	SaleNumber  string             `json:"saleNumber,omitempty" bson:"saleNumber,omitempty"`
+	TabID       primitive.ObjectID `json:"tabId,omitempty" bson:"tabId,omitempty"`
+	Table       string             `json:"table,omitempty" bson:"table,omitempty"`
+	Name        string             `json:"name,omitempty" bson:"name,omitempty"`
+	// OrderedBy is the staff member who sent the order
+	OrderedBy string       `json:"orderedBy,omitempty" bson:"orderedBy,omitempty"`
+	Items     []TicketItem `json:"items" bson:"items"`
+	Status    string       `json:"status" bson:"status"`
+	CreatedAt time.Time    `json:"createdAt" bson:"createdAt"`
+	StartedAt *time.Time   `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	ReadyAt   *time.Time   `json:"readyAt,omitempty" bson:"readyAt,omitempty"`
+	ServedAt  *time.Time   `json:"servedAt,omitempty" bson:"servedAt,omitempty"`
+	Version   int          `json:"version" bson:"version"`
+}
+
+// stamp records when something first reached a status
+func stamp(status string, now time.Time, started, ready, served **time.Time) {
+	set := func(at **time.Time) {
+		if *at == nil {
+			t := now
+			*at = &t
+		}
+	}
+	r := rank(status)
+	if r >= rank(StatusPreparing) {
+		set(started)
+	}
+	if r >= rank(StatusReady) {
+		set(ready)
+	}
+	if r >= rank(StatusServed) {
+		set(served)
+	}
+}
+
+// settle works out the ticket's status from its items
+func (t *Ticket) settle(now time.Time) {
+	status := StatusServed
+	for _, it := range t.Items {
+		if rank(it.Status) < rank(status) {
+			status = it.Status
+		}
+	}
+	t.Status = status
+	stamp(status, now, &t.StartedAt, &t.ReadyAt, &t.ServedAt)
+}
+
+// OrderLine is an item to be made
+type OrderLine struct {
+	LineID    primitive.ObjectID
+	ProductID primitive.ObjectID
+	Name      string
+	Quantity  int
+	Modifiers []string
+	Note      string
+	Seat      int
+	Course    int
+}
+
+// Order is a set of lines sent to the kitchen together, from a sale or a tab
+type Order struct {
+	Source     string
+	LocationID primitive.ObjectID
+	SaleID     primitive.ObjectID
+	SaleNumber string
+	TabID      primitive.ObjectID
+	Table      string
+	Name       string
+	OrderedBy  string
+	Lines      []OrderLine
+}
+
+// categories looks up the category of each product
+func categories(ctx context.Context, lines []OrderLine) (map[primitive.ObjectID]string, error) {
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+	cur, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"category": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	found := map[primitive.ObjectID]string{}
+	for cur.Next(ctx) {
+		var p struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Category string             `bson:"category"`
+		}
+		if err := cur.Decode(&p); err != nil {
+			return nil, err
+		}
+		found[p.ID] = p.Category
+	}
+	return found, cur.Err()
+}
+
+// route picks the stations a line of the given category goes to: those that
+// list the category, or failing that the catch-all stations
+func route(stations []Station, category string) []int {
+	var picked, catchAll []int
+	for i := range stations {
+		switch {
+		case len(stations[i].Categories) == 0:
+			catchAll = append(catchAll, i)
+		case stations[i].takes(category):
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) == 0 {
+		return catchAll
+	}
+	return picked
+}
+
+// Send routes an order's lines to the stations at its location and stores a
+// ticket for each station. Lines no station takes, such as drinks where
+// there is only a kitchen screen, are left off. A location with no stations
+// gets no tickets.
+func Send(ctx context.Context, o Order) ([]Ticket, error) {
+	if len(o.Lines) == 0 {
+		return nil, nil
+	}
+	stations, err := stationsFor(ctx, o.LocationID)
+	if err != nil || len(stations) == 0 {
+		return nil, err
+	}
+	cats, err := categories(ctx, o.Lines)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	byStation := map[int]*Ticket{}
+	var order []int
+	for _, l := range o.Lines {
+		for _, i := range route(stations, cats[l.ProductID]) {
+			t, ok := byStation[i]
+			if !ok {
+				t = &Ticket{
+					ID:          primitive.NewObjectID(),
+					StationID:   stations[i].ID,
+					StationName: stations[i].Name,
+					LocationID:  o.LocationID,
+					Source:      o.Source,
+					SaleID:      o.SaleID,
+					SaleNumber:  o.SaleNumber,
+					TabID:       o.TabID,
+					Table:       o.Table,
+					Name:        o.Name,
+					OrderedBy:   o.OrderedBy,
+					Items:       []TicketItem{},
+					Status:      StatusNew,
+					CreatedAt:   now,
+					Version:     1,
+				}
+				byStation[i] = t
+				order = append(order, i)
+			}
+			t.Items = append(t.Items, TicketItem{
+				ID:        primitive.NewObjectID(),
+				LineID:    l.LineID,
+				ProductID: l.ProductID,
+				Name:      l.Name,
+				Quantity:  l.Quantity,
+				Modifiers: l.Modifiers,
+				Note:      l.Note,
+				Seat:      l.Seat,
+				Course:    l.Course,
+				Status:    StatusNew,
+			})
+		}
+	}
+	if len(order) == 0 {
+		return nil, nil
+	}
+	coll, err := db.GetCollection(ticketsCollection)
+	if err != nil {
+		return nil, err
+	}
+	tickets := make([]Ticket, 0, len(order))
+	docs := make([]interface{}, 0, len(order))
+	for _, i := range order {
+		tickets = append(tickets, *byStation[i])
+		docs = append(docs, byStation[i])
+	}
+	if _, err := coll.InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+	for _, t := range tickets {
+		events.publish(Event{Type: EventCreated, Ticket: t})
+	}
+	return tickets, nil
+}
+
+var (
+	errNotFound = errors.New("ticket not found")
+	errChanged  = errors.New("ticket changed")
+	errStatus   = errors.New("invalid status")
+)
+
+// bump moves a ticket, or one of its items, to a status. With no status it
+// moves to the next one. Items already further on are left alone when the
+// whole ticket is bumped.
+func bump(ctx context.Context, id, itemID primitive.ObjectID, status string) (*Ticket, error) {
+	coll, err := db.GetCollection(ticketsCollection)
+	if err != nil {
+		return nil, err
+	}
+	var t Ticket
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&t); err == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if status != "" && rank(status) < 0 {
+		return nil, errStatus
+	}
+	now := time.Now()
+	found := itemID.IsZero()
+	for i := range t.Items {
+		it := &t.Items[i]
+		if !itemID.IsZero() && it.ID != itemID {
+			continue
+		}
+		found = true
+		to := status
+		if to == "" {
+			from := it.Status
+			if itemID.IsZero() {
+				from = t.Status
+			}
+			if next := rank(from) + 1; next < len(statusOrder) {
+				to = statusOrder[next]
+			} else {
+				to = from
+			}
+		}
+		if itemID.IsZero() && rank(it.Status) >= rank(to) {
+			continue
+		}
+		it.Status = to
+		stamp(to, now, &it.StartedAt, &it.ReadyAt, &it.ServedAt)
+	}
+	if !found {
+		return nil, errNotFound
+	}
+	t.settle(now)
+	version := t.Version
+	t.Version++
+	res, err := coll.ReplaceOne(ctx, bson.M{"_id": id, "version": version}, t)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, errChanged
+	}
+	events.publish(Event{Type: EventUpdated, Ticket: t})
+	return &t, nil
+}
+
+// KDSHandler handles /api/kds/stations, /api/kds/tickets, /api/kds/stream and
+// /api/kds/timings
+func KDSHandler(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path)
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	}
+	switch parts[2] {
+	case "stations":
+		stationsHandler(w, r, parts[3:])
+	case "tickets":
+		ticketsHandler(w, r, parts[3:])
+	case "stream":
+		streamHandler(w, r)
+	case "timings":
+		timingsHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+	}
+}
+
+// ticketsHandler handles GET /api/kds/tickets, GET /api/kds/tickets/{id} and
+// POST /api/kds/tickets/{id}/bump
+func ticketsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		listTickets(ctx, w, r)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		coll, err := db.GetCollection(ticketsCollection)
+		if err != nil {
+			log.Printf("db error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		var t Ticket
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&t); err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		} else if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	case len(parts) == 2 && parts[1] == "bump" && r.Method == http.MethodPost:
+		var req struct {
+			ItemID primitive.ObjectID `json:"itemId"`
+			Status string             `json:"status"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid input"}`))
+				return
+			}
+		}
+		t, err := bump(ctx, id, req.ItemID, req.Status)
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+		case errors.Is(err, errStatus):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"status must be new, preparing, ready or served"}`))
+		case errors.Is(err, errChanged):
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"ticket changed, try again"}`))
+		case err != nil:
+			log.Printf("bump error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(t)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// listTickets handles GET /api/kds/tickets?stationId=&locationId=&status=&tabId=&saleId=.
+// Without a status it lists the tickets not yet served, oldest first.
+func listTickets(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{"status": bson.M{"$ne": StatusServed}}
+	if s := q.Get("status"); s != "" {
+		if rank(s) < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"status must be new, preparing, ready or served"}`))
+			return
+		}
+		filter["status"] = s
+	}
+	for param, field := range map[string]string{"stationId": "stationId", "locationId": "locationId", "tabId": "tabId", "saleId": "saleId"} {
+		if v := q.Get(param); v != "" {
+			id, err := primitive.ObjectIDFromHex(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid ` + param + `"}`))
+				return
+			}
+			filter[field] = id
+		}
+	}
+	coll, err := db.GetCollection(ticketsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}).SetLimit(500)
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	defer cur.Close(ctx)
+	tickets := []Ticket{}
+	if err := cur.All(ctx, &tickets); err != nil {
+		log.Printf("decode error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tickets)
+}
@@ -0,0 +1,169 @@
+package kds
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const stationsCollection = "kds_stations"
+
+// Station is a kitchen screen, such as grill or pass. It receives items in
+// its categories; a station with no categories takes anything no other
+// station at the location does. A station with no location serves them all.
+type Station struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name       string             `json:"name" bson:"name"`
+	Categories []string           `json:"categories" bson:"categories"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+}
+
+func (s *Station) takes(category string) bool {
+	for _, c := range s.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// stationsFor lists the stations serving a location
+func stationsFor(ctx context.Context, location primitive.ObjectID) ([]Station, error) {
+	coll, err := db.GetCollection(stationsCollection)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"locationId": bson.M{"$exists": false}}
+	if !location.IsZero() {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"locationId": location}}}
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	stations := []Station{}
+	err = cur.All(ctx, &stations)
+	return stations, err
+}
+
+// stationsHandler handles /api/kds/stations and /api/kds/stations/{id}
+func stationsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	coll, err := db.GetCollection(stationsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			loc, _ := primitive.ObjectIDFromHex(r.URL.Query().Get("locationId"))
+			stations, err := stationsFor(ctx, loc)
+			if err != nil {
+				log.Printf("find error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(stations)
+		case http.MethodPost:
+			var s Station
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Name == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"name required"}`))
+				return
+			}
+			s.ID = primitive.NewObjectID()
+			if s.Categories == nil {
+				s.Categories = []string{}
+			}
+			if _, err := coll.InsertOne(ctx, s); err != nil {
+				log.Printf("insert error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(s)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var s Station
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"name required"}`))
+			return
+		}
+		s.ID = id
+		if s.Categories == nil {
+			s.Categories = []string{}
+		}
+		res, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, s)
+		if err != nil {
+			log.Printf("update error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.MatchedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case http.MethodDelete:
+		res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			log.Printf("delete error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.DeletedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		var s Station
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s); err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		} else if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,125 @@
+package kds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event types sent to subscribers
+const (
+	EventCreated = "ticket.created"
+	EventUpdated = "ticket.updated"
+)
+
+// Event is a change to a ticket, as streamed to screens and tills
+type Event struct {
+	Type   string `json:"type"`
+	Ticket Ticket `json:"ticket"`
+}
+
+// subscription picks the events one stream wants; zero IDs match anything
+type subscription struct {
+	station  primitive.ObjectID
+	location primitive.ObjectID
+	tab      primitive.ObjectID
+	events   chan Event
+}
+
+func (s *subscription) wants(t *Ticket) bool {
+	return (s.station.IsZero() || s.station == t.StationID) &&
+		(s.location.IsZero() || s.location == t.LocationID) &&
+		(s.tab.IsZero() || s.tab == t.TabID)
+}
+
+// hub fans ticket events out to the streams connected to this server
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscription]bool
+}
+
+var events = &hub{subs: map[*subscription]bool{}}
+
+func (h *hub) subscribe(s *subscription) {
+	h.mu.Lock()
+	h.subs[s] = true
+	h.mu.Unlock()
+}
+
+func (h *hub) unsubscribe(s *subscription) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// publish sends an event to every interested stream. A stream too far behind
+// misses it rather than holding up the kitchen; screens resync by reloading
+// the open tickets.
+func (h *hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.wants(&e.Ticket) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+}
+
+// keepAlive is how often an idle stream gets a comment so proxies keep it open
+const keepAlive = 15 * time.Second
+
+// streamHandler handles GET /api/kds/stream?stationId=&locationId=&tabId=
+// as server-sent events
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"streaming unsupported"}`))
+		return
+	}
+	q := r.URL.Query()
+	sub := &subscription{events: make(chan Event, 64)}
+	sub.station, _ = primitive.ObjectIDFromHex(q.Get("stationId"))
+	sub.location, _ = primitive.ObjectIDFromHex(q.Get("locationId"))
+	sub.tab, _ = primitive.ObjectIDFromHex(q.Get("tabId"))
+	events.subscribe(sub)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case e := <-sub.events:
+			data, err := json.Marshal(e.Ticket)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", e.Type, e.Ticket.ID.Hex(), data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package kds
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StationTimings is the average time, in seconds, a station's tickets spent
+// at each stage
+type StationTimings struct {
+	StationID   primitive.ObjectID `json:"stationId"`
+	StationName string             `json:"stationName"`
+	Tickets     int                `json:"tickets"`
+	// Waiting is from sent to started
+	Waiting float64 `json:"waiting"`
+	// Preparing is from started to ready
+	Preparing float64 `json:"preparing"`
+	// Pass is from ready to served
+	Pass float64 `json:"pass"`
+	// Total is from sent to ready
+	Total float64 `json:"total"`
+}
+
+// average totals durations and how many there were
+type average struct {
+	sum float64
+	n   int
+}
+
+func (a *average) add(from time.Time, to *time.Time) {
+	if to != nil {
+		a.sum += to.Sub(from).Seconds()
+		a.n++
+	}
+}
+
+func (a *average) value() float64 {
+	if a.n == 0 {
+		return 0
+	}
+	return math.Round(a.sum/float64(a.n)*10) / 10
+}
+
+// parseTime parses a date or RFC 3339 time. A bare end date includes the
+// whole of that day.
+func parseTime(s string, end bool) (*time.Time, bool) {
+	if s == "" {
+		return nil, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, true
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return nil, false
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, true
+}
+
+// timingsHandler handles GET /api/kds/timings?from=&to=&stationId=&locationId=
+func timingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	from, ok1 := parseTime(q.Get("from"), false)
+	to, ok2 := parseTime(q.Get("to"), true)
+	if !ok1 || !ok2 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid from or to"}`))
+		return
+	}
+	filter := bson.M{}
+	if from != nil || to != nil {
+		created := bson.M{}
+		if from != nil {
+			created["$gte"] = *from
+		}
+		if to != nil {
+			created["$lt"] = *to
+		}
+		filter["createdAt"] = created
+	}
+	if id, err := primitive.ObjectIDFromHex(q.Get("stationId")); err == nil {
+		filter["stationId"] = id
+	}
+	if id, err := primitive.ObjectIDFromHex(q.Get("locationId")); err == nil {
+		filter["locationId"] = id
+	}
+	coll, err := db.GetCollection(ticketsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	defer cur.Close(ctx)
+	type stages struct {
+		name                            string
+		tickets                         int
+		waiting, preparing, pass, total average
+	}
+	byStation := map[primitive.ObjectID]*stages{}
+	for cur.Next(ctx) {
+		var t Ticket
+		if err := cur.Decode(&t); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		s, ok := byStation[t.StationID]
+		if !ok {
+			s = &stages{name: t.StationName}
+			byStation[t.StationID] = s
+		}
+		s.tickets++
+		s.waiting.add(t.CreatedAt, t.StartedAt)
+		if t.StartedAt != nil {
+			s.preparing.add(*t.StartedAt, t.ReadyAt)
+		}
+		if t.ReadyAt != nil {
+			s.pass.add(*t.ReadyAt, t.ServedAt)
+		}
+		s.total.add(t.CreatedAt, t.ReadyAt)
+	}
+	if err := cur.Err(); err != nil {
+		log.Printf("cursor error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	timings := []StationTimings{}
+	for id, s := range byStation {
+		timings = append(timings, StationTimings{
+			StationID:   id,
+			StationName: s.name,
+			Tickets:     s.tickets,
+			Waiting:     s.waiting.value(),
+			Preparing:   s.preparing.value(),
+			Pass:        s.pass.value(),
+			Total:       s.total.value(),
+		})
+	}
+	sort.Slice(timings, func(i, j int) bool { return timings[i].StationName < timings[j].StationName })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timings)
+}
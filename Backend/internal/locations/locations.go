@@ -9,19 +9,54 @@ import (
 	"strconv"
 	"time"
 
+	"hospos-backend/internal/business"
 	"hospos-backend/internal/db"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Location struct {
 	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	Name     string             `json:"name" bson:"name"`
 	LinkCode string             `json:"linkCode" bson:"linkCode"`
+	// ServiceChargePercent is the optional service charge; it is added
+	// automatically for parties of ServiceChargeMinCovers or more (0 never)
+	ServiceChargePercent   float64 `json:"serviceChargePercent" bson:"serviceChargePercent"`
+	ServiceChargeMinCovers int     `json:"serviceChargeMinCovers" bson:"serviceChargeMinCovers"`
+	// ServiceChargeVATable marks a compulsory charge, which bears VAT; a
+	// discretionary one is outside its scope
+	ServiceChargeVATable bool `json:"serviceChargeVatable" bson:"serviceChargeVatable"`
+	// PricingMode overrides the business's (inclusive or exclusive) for
+	// this location; empty follows the business
+	PricingMode string `json:"pricingMode,omitempty" bson:"pricingMode,omitempty"`
+}
+
+// Get returns a location, or nil if there is none with that ID
+func Get(ctx context.Context, id primitive.ObjectID) (*Location, error) {
+	if id.IsZero() {
+		return nil, nil
+	}
+	coll, err := db.GetCollection("locations")
+	if err != nil {
+		return nil, err
+	}
+	var l Location
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&l); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &l, nil
 }
 
 func LocationsHandler(w http.ResponseWriter, r *http.Request) {
+	if parts := splitPath(r.URL.Path); len(parts) == 3 {
+		updateLocation(w, r, parts[2])
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		coll, err := db.GetCollection("locations")
@@ -67,6 +102,11 @@ func LocationsHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`{"error":"name required"}`))
 			return
 		}
+		if !business.ValidPricingMode(l.PricingMode) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"pricingMode must be inclusive, exclusive or empty"}`))
+			return
+		}
 		// Generate a unique 12-digit numeric linking code
 		l.ID = primitive.NewObjectID()
 		l.LinkCode = generateNumericLinkCode(12)
@@ -95,6 +135,92 @@ func LocationsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// updateLocation handles PATCH /api/locations/{id}
+func updateLocation(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodPatch {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	var req struct {
+		Name                   *string  `json:"name"`
+		ServiceChargePercent   *float64 `json:"serviceChargePercent"`
+		ServiceChargeMinCovers *int     `json:"serviceChargeMinCovers"`
+		ServiceChargeVATable   *bool    `json:"serviceChargeVatable"`
+		PricingMode            *string  `json:"pricingMode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	set := bson.M{}
+	if req.Name != nil && *req.Name != "" {
+		set["name"] = *req.Name
+	}
+	if p := req.ServiceChargePercent; p != nil {
+		if *p < 0 || *p > 100 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"serviceChargePercent must be between 0 and 100"}`))
+			return
+		}
+		set["serviceChargePercent"] = *p
+	}
+	if n := req.ServiceChargeMinCovers; n != nil {
+		if *n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid serviceChargeMinCovers"}`))
+			return
+		}
+		set["serviceChargeMinCovers"] = *n
+	}
+	if req.ServiceChargeVATable != nil {
+		set["serviceChargeVatable"] = *req.ServiceChargeVATable
+	}
+	if m := req.PricingMode; m != nil {
+		if !business.ValidPricingMode(*m) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"pricingMode must be inclusive, exclusive or empty"}`))
+			return
+		}
+		set["pricingMode"] = *m
+	}
+	if len(set) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"no fields to update"}`))
+		return
+	}
+	coll, err := db.GetCollection("locations")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var l Location
+	err = coll.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
 // generateNumericLinkCode returns a random numeric string of the given length
 func generateNumericLinkCode(length int) string {
 	rand.Seed(time.Now().UnixNano())
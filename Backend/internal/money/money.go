@@ -0,0 +1,327 @@
+// Package money holds amounts as whole minor units (pence), so totals add up
+// exactly, and rounds shares of them by an explicit rule.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Money is an amount in minor units of the business currency, e.g. pence.
+// It is stored as a 64-bit integer and reads and writes JSON as a decimal
+// number of major units (12.50), as clients have always sent it. The
+// currency code is not repeated on every amount: each record holding amounts
+// stores it once beside them, in a currency field.
+type Money int64
+
+// Scale is the number of minor units in a major unit
+const Scale = 100
+
+// DefaultCurrency is used when the business has no currency set
+const DefaultCurrency = "GBP"
+
+// ValidCurrency reports whether code looks like an ISO 4217 currency code:
+// three capital letters, such as GBP or EUR. Only currencies with 100 minor
+// units to the major one are supported.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Rounding says which way an amount exactly halfway between two pence goes
+type Rounding int
+
+const (
+	// HalfUp rounds halves away from zero: 0.125 becomes 0.13
+	HalfUp Rounding = iota
+	// HalfEven rounds halves to the even penny, so over many amounts they
+	// balance out: 0.125 becomes 0.12 and 0.135 becomes 0.14 (banker's)
+	HalfEven
+)
+
+// ParseRounding reads a rounding rule as written in settings
+func ParseRounding(s string) (Rounding, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "half-up", "halfup":
+		return HalfUp, true
+	case "half-even", "halfeven", "bankers", "banker's":
+		return HalfEven, true
+	}
+	return HalfUp, false
+}
+
+// RoundingFromEnv reads a rounding rule from an environment variable, or
+// returns def when it is unset or not understood
+func RoundingFromEnv(name string, def Rounding) Rounding {
+	if r, ok := ParseRounding(os.Getenv(name)); ok {
+		return r
+	}
+	return def
+}
+
+var errFormat = errors.New("money: invalid amount")
+
+// Parse reads a decimal amount of major units such as "12.5" or "-0.05".
+// Digits past the penny are rounded half up.
+func Parse(s string) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, errFormat
+	}
+	return round(r.Mul(r, big.NewRat(Scale, 1)), HalfUp)
+}
+
+// FromFloat converts a float amount of major units, such as an amount stored
+// before amounts were kept in pence. The float is read at its shortest
+// decimal form, so 0.1+0.2 is 0.30 and not 0.30000000000000004.
+func FromFloat(f float64) Money {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	m, err := Parse(strconv.FormatFloat(f, 'f', -1, 64))
+	if err != nil {
+		return 0
+	}
+	return m
+}
+
+// Float returns the amount in major units, for display and reports only
+func (m Money) Float() float64 {
+	return float64(m) / Scale
+}
+
+// String formats the amount in major units with two decimals
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/Scale, v%Scale)
+}
+
+// IsZero reports whether the amount is nothing, for omitempty
+func (m Money) IsZero() bool {
+	return m == 0
+}
+
+// Abs returns the amount without its sign
+func (m Money) Abs() Money {
+	if m < 0 {
+		return -m
+	}
+	return m
+}
+
+// Times multiplies the amount by a quantity
+func (m Money) Times(qty int) Money {
+	return m * Money(qty)
+}
+
+// Percent returns pct percent of the amount, rounded to the penny
+func (m Money) Percent(pct float64, mode Rounding) Money {
+	return m.MulDiv(decimal(pct), big.NewRat(100, 1), mode)
+}
+
+// TaxIn returns the tax contained in a tax-inclusive amount at rate percent:
+// amount × rate / (100 + rate), so 1/6 at 20%
+func (m Money) TaxIn(rate float64, mode Rounding) Money {
+	r := decimal(rate)
+	return m.MulDiv(r, new(big.Rat).Add(r, big.NewRat(100, 1)), mode)
+}
+
+// TaxOn returns the tax due on a tax-exclusive amount at rate percent
+func (m Money) TaxOn(rate float64, mode Rounding) Money {
+	return m.Percent(rate, mode)
+}
+
+// ForQty returns the amount for qty of something costing m per per units,
+// rounded to the penny, e.g. 350 ml of a bottle of 700 ml. Quantities are
+// read at their shortest decimal form.
+func (m Money) ForQty(qty, per float64, mode Rounding) Money {
+	return m.MulDiv(decimal(qty), decimal(per), mode)
+}
+
+// Fraction returns num/den of the amount, rounded to the penny, e.g. the
+// share of a total that one line makes up
+func (m Money) Fraction(num, den int64, mode Rounding) Money {
+	return m.MulDiv(big.NewRat(num, 1), big.NewRat(den, 1), mode)
+}
+
+// MulDiv returns the amount × num / den, rounded to the penny. It is exact
+// until the final rounding.
+func (m Money) MulDiv(num, den *big.Rat, mode Rounding) Money {
+	if den.Sign() == 0 {
+		return 0
+	}
+	r := new(big.Rat).SetInt64(int64(m))
+	r.Mul(r, num)
+	r.Quo(r, den)
+	v, _ := round(r, mode)
+	return v
+}
+
+// decimal reads a float such as a percentage at its shortest decimal form,
+// so 17.5 and 12.3 are exact
+func decimal(f float64) *big.Rat {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
+
+// round rounds an exact number of minor units to a whole one
+func round(r *big.Rat, mode Rounding) (Money, error) {
+	num, den := new(big.Int).Set(r.Num()), r.Denom()
+	neg := num.Sign() < 0
+	num.Abs(num)
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	// Compare twice the remainder with the denominator to find the half
+	switch new(big.Int).Lsh(rem, 1).Cmp(den) {
+	case 1:
+		q.Add(q, big.NewInt(1))
+	case 0:
+		if mode == HalfUp || q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return 0, errFormat
+	}
+	v := q.Int64()
+	if neg {
+		v = -v
+	}
+	return Money(v), nil
+}
+
+// Allocate shares total out in proportion to the weights, to the penny. Each
+// share is rounded down and the pennies left over go to the largest
+// remainders, earliest first, so the shares always add up to the total.
+// With no weight to go on the total is split evenly.
+func Allocate(total Money, weights []float64) []Money {
+	shares := make([]Money, len(weights))
+	if len(weights) == 0 {
+		return shares
+	}
+	sum := new(big.Rat)
+	ws := make([]*big.Rat, len(weights))
+	for i, w := range weights {
+		if w < 0 {
+			w = 0
+		}
+		ws[i] = decimal(w)
+		sum.Add(sum, ws[i])
+	}
+	if sum.Sign() == 0 {
+		for i := range ws {
+			ws[i] = big.NewRat(1, 1)
+		}
+		sum = big.NewRat(int64(len(ws)), 1)
+	}
+	neg := total < 0
+	abs := total
+	if neg {
+		abs = -total
+	}
+	rests := make([]*big.Rat, len(ws))
+	given := Money(0)
+	for i, w := range ws {
+		exact := new(big.Rat).SetInt64(int64(abs))
+		exact.Mul(exact, w)
+		exact.Quo(exact, sum)
+		floor := new(big.Int).Quo(exact.Num(), exact.Denom())
+		shares[i] = Money(floor.Int64())
+		rests[i] = exact.Sub(exact, new(big.Rat).SetInt(floor))
+		given += shares[i]
+	}
+	for given < abs {
+		best := 0
+		for i := range rests {
+			if rests[i].Cmp(rests[best]) > 0 {
+				best = i
+			}
+		}
+		shares[best]++
+		rests[best] = new(big.Rat).Sub(rests[best], big.NewRat(1, 1))
+		given++
+	}
+	if neg {
+		for i := range shares {
+			shares[i] = -shares[i]
+		}
+	}
+	return shares
+}
+
+// MarshalJSON writes the amount as a decimal number of major units
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON reads a decimal number of major units, or a string holding
+// one
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "null" {
+		return nil
+	}
+	s = strings.Trim(s, `"`)
+	v, err := Parse(s)
+	if err != nil {
+		return fmt.Errorf("money: invalid amount %s", b)
+	}
+	*m = v
+	return nil
+}
+
+// MarshalBSONValue stores the amount as a 64-bit integer of minor units
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bsontype.Int64, bsoncore.AppendInt64(nil, int64(m)), nil
+}
+
+// UnmarshalBSONValue reads minor units. A double is an amount stored in major
+// units before amounts were kept in pence and is converted.
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bsontype.Int64:
+		v, _, ok := bsoncore.ReadInt64(data)
+		if !ok {
+			return errFormat
+		}
+		*m = Money(v)
+	case bsontype.Int32:
+		v, _, ok := bsoncore.ReadInt32(data)
+		if !ok {
+			return errFormat
+		}
+		*m = Money(v)
+	case bsontype.Double:
+		v, _, ok := bsoncore.ReadDouble(data)
+		if !ok {
+			return errFormat
+		}
+		*m = FromFloat(v)
+	case bsontype.Null, bsontype.Undefined:
+		*m = 0
+	default:
+		return fmt.Errorf("money: cannot read %s", t)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		err  bool
+	}{
+		{"12.5", 1250, false},
+		{" 3 ", 300, false},
+		{"-0.05", -5, false},
+		{"0.125", 13, false},
+		{"-0.125", -13, false},
+		{"0.124", 12, false},
+		{"", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Parse(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromFloat(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want Money
+	}{
+		{12.5, 1250},
+		{0.1 + 0.2, 30},
+		{1.005, 101},
+		{-1.005, -101},
+		{math.NaN(), 0},
+		{math.Inf(1), 0},
+	}
+	for _, tt := range tests {
+		if got := FromFloat(tt.in); got != tt.want {
+			t.Errorf("FromFloat(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{1250, "12.50"},
+		{-5, "-0.05"},
+		{-1234, "-12.34"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  func(Rounding) Money
+		up   Money
+		even Money
+	}{
+		{"10% of 1.25", func(r Rounding) Money { return Money(125).Percent(10, r) }, 13, 12},
+		{"10% of 1.35", func(r Rounding) Money { return Money(135).Percent(10, r) }, 14, 14},
+		{"10% of -1.25", func(r Rounding) Money { return Money(-125).Percent(10, r) }, -13, -12},
+		{"17.5% of 1.00", func(r Rounding) Money { return Money(100).Percent(17.5, r) }, 18, 18},
+		{"half of 0.05", func(r Rounding) Money { return Money(5).Fraction(1, 2, r) }, 3, 2},
+		{"half of 0.07", func(r Rounding) Money { return Money(7).Fraction(1, 2, r) }, 4, 4},
+		{"half of -0.05", func(r Rounding) Money { return Money(-5).Fraction(1, 2, r) }, -3, -2},
+		{"third of 10.00", func(r Rounding) Money { return Money(1000).Fraction(1, 3, r) }, 333, 333},
+		{"zero denominator", func(r Rounding) Money { return Money(1000).Fraction(1, 0, r) }, 0, 0},
+		{"VAT in 12.00 at 20%", func(r Rounding) Money { return Money(1200).TaxIn(20, r) }, 200, 200},
+		{"VAT in 10.00 at 20%", func(r Rounding) Money { return Money(1000).TaxIn(20, r) }, 167, 167},
+		{"VAT in 0.21 at 5%", func(r Rounding) Money { return Money(21).TaxIn(5, r) }, 1, 1},
+		{"VAT on 0.25 at 10%", func(r Rounding) Money { return Money(25).TaxOn(10, r) }, 3, 2},
+		{"350 ml of a 10.50 bottle of 700", func(r Rounding) Money { return Money(1050).ForQty(350, 700, r) }, 525, 525},
+		{"1 ml of a 0.05 bottle of 2", func(r Rounding) Money { return Money(5).ForQty(1, 2, r) }, 3, 2},
+	}
+	for _, tt := range tests {
+		if got := tt.got(HalfUp); got != tt.up {
+			t.Errorf("%s half up = %d, want %d", tt.name, got, tt.up)
+		}
+		if got := tt.got(HalfEven); got != tt.even {
+			t.Errorf("%s half even = %d, want %d", tt.name, got, tt.even)
+		}
+	}
+}
+
+func TestParseRounding(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rounding
+		ok   bool
+	}{
+		{"half-up", HalfUp, true},
+		{" Half-Even ", HalfEven, true},
+		{"bankers", HalfEven, true},
+		{"", HalfUp, false},
+		{"nearest", HalfUp, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseRounding(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseRounding(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   Money
+		weights []float64
+		want    []Money
+	}{
+		{"even thirds", 100, []float64{1, 1, 1}, []Money{34, 33, 33}},
+		{"negative thirds", -100, []float64{1, 1, 1}, []Money{-34, -33, -33}},
+		{"largest remainder", 1000, []float64{1, 2}, []Money{333, 667}},
+		{"two pennies over three", 2, []float64{1, 1, 1}, []Money{1, 1, 0}},
+		{"proportional", 1000, []float64{12.5, 37.5}, []Money{250, 750}},
+		{"negative proportional", -1001, []float64{1, 1}, []Money{-501, -500}},
+		{"zero weights split evenly", 7, []float64{0, 0}, []Money{4, 3}},
+		{"negative weight counts as zero", 100, []float64{-1, 1}, []Money{0, 100}},
+		{"zero total", 0, []float64{1, 2}, []Money{0, 0}},
+		{"no weights", 100, nil, []Money{}},
+	}
+	for _, tt := range tests {
+		got := Allocate(tt.total, tt.weights)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Allocate(%d, %v) = %v, want %v", tt.name, tt.total, tt.weights, got, tt.want)
+			continue
+		}
+		var sum Money
+		for _, s := range got {
+			sum += s
+		}
+		if len(got) > 0 && sum != tt.total {
+			t.Errorf("%s: shares add up to %d, want %d", tt.name, sum, tt.total)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	marshal := []struct {
+		in   Money
+		want string
+	}{
+		{1250, `{"a":12.50}`},
+		{-5, `{"a":-0.05}`},
+		{0, `{"a":0.00}`},
+	}
+	for _, tt := range marshal {
+		b, err := json.Marshal(struct {
+			A Money `json:"a"`
+		}{tt.in})
+		if err != nil {
+			t.Errorf("marshal %d: %v", tt.in, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("marshal %d = %s, want %s", tt.in, b, tt.want)
+		}
+	}
+
+	unmarshal := []struct {
+		in   string
+		want Money
+		err  bool
+	}{
+		{`{"a":12.5}`, 1250, false},
+		{`{"a":"12.50"}`, 1250, false},
+		{`{"a":-0.05}`, -5, false},
+		{`{"a":0.125}`, 13, false},
+		{`{"a":null}`, 99, false},
+		{`{"a":"x"}`, 0, true},
+		{`{"a":true}`, 0, true},
+	}
+	for _, tt := range unmarshal {
+		v := struct {
+			A Money `json:"a"`
+		}{99}
+		err := json.Unmarshal([]byte(tt.in), &v)
+		if (err != nil) != tt.err {
+			t.Errorf("unmarshal %s error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && v.A != tt.want {
+			t.Errorf("unmarshal %s = %d, want %d", tt.in, v.A, tt.want)
+		}
+	}
+
+	for _, m := range []Money{0, 1, -1, 1250, -1234567} {
+		b, _ := json.Marshal(m)
+		var back Money
+		if err := json.Unmarshal(b, &back); err != nil || back != m {
+			t.Errorf("round trip %d via %s = %d, %v", m, b, back, err)
+		}
+	}
+}
+
+func TestBSON(t *testing.T) {
+	type doc struct {
+		A Money `bson:"a"`
+	}
+	for _, m := range []Money{0, 1250, -5, math.MaxInt64} {
+		b, err := bson.Marshal(doc{m})
+		if err != nil {
+			t.Errorf("marshal %d: %v", m, err)
+			continue
+		}
+		if typ := bson.Raw(b).Lookup("a").Type; typ != bsontype.Int64 {
+			t.Errorf("marshal %d stored as %s, want int64", m, typ)
+		}
+		var back doc
+		if err := bson.Unmarshal(b, &back); err != nil || back.A != m {
+			t.Errorf("round trip %d = %d, %v", m, back.A, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   bson.M
+		want Money
+		err  bool
+	}{
+		{"int64 pence", bson.M{"a": int64(1250)}, 1250, false},
+		{"int32 pence", bson.M{"a": int32(-7)}, -7, false},
+		{"legacy double", bson.M{"a": 12.5}, 1250, false},
+		{"legacy negative double", bson.M{"a": -0.05}, -5, false},
+		{"legacy double past the penny", bson.M{"a": 0.125}, 13, false},
+		{"null", bson.M{"a": nil}, 0, false},
+		{"string", bson.M{"a": "12.50"}, 0, true},
+	}
+	for _, tt := range tests {
+		b, err := bson.Marshal(tt.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		v := doc{99}
+		err = bson.Unmarshal(b, &v)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && v.A != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, v.A, tt.want)
+		}
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"GBP", true},
+		{"EUR", true},
+		{"gbp", false},
+		{"EURO", false},
+		{"G1P", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ValidCurrency(tt.in); got != tt.want {
+			t.Errorf("ValidCurrency(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a single notification. Data is passed through to webhooks as-is.
+type Message struct {
+	Subject string      `json:"subject"`
+	Body    string      `json:"body"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Notifier delivers messages to staff
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// LogNotifier writes messages to the server log
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, msg Message) error {
+	log.Printf("[NOTIFY] %s: %s", msg.Subject, msg.Body)
+	return nil
+}
+
+// SMTPNotifier sends messages as plain-text email
+type SMTPNotifier struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (n SMTPNotifier) Notify(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host := n.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.From, strings.Join(n.To, ", "), msg.Subject, msg.Body)
+	return smtp.SendMail(n.Addr, auth, n.From, n.To, []byte(body))
+}
+
+// WebhookNotifier posts messages as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+var (
+	defaultNotifier Notifier
+	defaultOnce     sync.Once
+)
+
+// Default returns the notifier configured by NOTIFIER (log, smtp or webhook).
+// It falls back to logging when the chosen notifier is not fully configured.
+func Default() Notifier {
+	defaultOnce.Do(func() {
+		defaultNotifier = fromEnv()
+	})
+	return defaultNotifier
+}
+
+func fromEnv() Notifier {
+	switch os.Getenv("NOTIFIER") {
+	case "smtp":
+		n := SMTPNotifier{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASS"),
+			From:     os.Getenv("NOTIFY_EMAIL_FROM"),
+		}
+		for _, to := range strings.Split(os.Getenv("NOTIFY_EMAIL_TO"), ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				n.To = append(n.To, to)
+			}
+		}
+		if n.Addr != "" && n.From != "" && len(n.To) > 0 {
+			return n
+		}
+		log.Printf("notify: smtp not fully configured, falling back to log")
+	case "webhook":
+		if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+			return WebhookNotifier{URL: url}
+		}
+		log.Printf("notify: NOTIFY_WEBHOOK_URL not set, falling back to log")
+	}
+	return LogNotifier{}
+}
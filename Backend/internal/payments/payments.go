@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"time"
 
+	"hospos-backend/internal/business"
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,8 +18,11 @@ import (
 type Payment struct {
 	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	SaleID primitive.ObjectID `json:"sale_id" bson:"sale_id"`
-	Amount float64            `json:"amount" bson:"amount"`
+	Amount money.Money        `json:"amount" bson:"amount"`
 	Method string             `json:"method" bson:"method"`
+	Tip    money.Money        `json:"tip,omitempty" bson:"tip,omitempty"`
+	// Currency is the code Amount and Tip are in
+	Currency string `json:"currency,omitempty" bson:"currency,omitempty"`
 }
 
 // No in-memory payments; use MongoDB
@@ -69,6 +74,7 @@ func PaymentsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
+		p.Currency = business.Currency(ctx)
 		res, err := coll.InsertOne(ctx, p)
 		if err != nil {
 			log.Printf("insert error: %v", err)
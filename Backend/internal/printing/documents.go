@@ -0,0 +1,301 @@
+package printing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/kds"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// productInfo is what kitchen tickets need to know about a product
+type productInfo struct {
+	Category  string   `bson:"category"`
+	Allergens []string `bson:"allergens"`
+}
+
+func productInfos(ctx context.Context, lines []kds.OrderLine) (map[primitive.ObjectID]productInfo, error) {
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+	cur, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"category": 1, "allergens": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	found := map[primitive.ObjectID]productInfo{}
+	for cur.Next(ctx) {
+		var p struct {
+			ID          primitive.ObjectID `bson:"_id"`
+			productInfo `bson:",inline"`
+		}
+		if err := cur.Decode(&p); err != nil {
+			return nil, err
+		}
+		found[p.ID] = p.productInfo
+	}
+	return found, cur.Err()
+}
+
+// kitchenRoute picks the kitchen printers for a category: those that list
+// it, or failing that the kitchen printers with no categories
+func kitchenRoute(printers []Printer, category string) []int {
+	var picked, catchAll []int
+	for i := range printers {
+		switch {
+		case !printers[i].Kitchen:
+		case len(printers[i].Categories) == 0:
+			catchAll = append(catchAll, i)
+		case printers[i].takes(category):
+			picked = append(picked, i)
+		}
+	}
+	if len(picked) == 0 {
+		return catchAll
+	}
+	return picked
+}
+
+// kitchenLine is an order line with its allergens, as printed
+type kitchenLine struct {
+	kds.OrderLine
+	Allergens []string
+}
+
+// kitchenTicket lays out the lines of an order for one kitchen printer
+func kitchenTicket(printer string, o kds.Order, lines []kitchenLine, at time.Time) []byte {
+	b := NewBuilder()
+	b.Align(AlignCenter).Bold(true).Size(2, 2)
+	switch {
+	case o.Table != "":
+		b.Line("TABLE " + o.Table)
+	case o.Name != "":
+		b.Line(o.Name)
+	case o.SaleNumber != "":
+		b.Line(o.SaleNumber)
+	}
+	b.Size(1, 1).Bold(false).Line(printer)
+	b.Align(AlignLeft).Line(at.Format("02/01 15:04") + "  " + o.OrderedBy).Rule()
+	for _, l := range lines {
+		b.Bold(true).Size(1, 2)
+		label := fmt.Sprintf("%d x %s", l.Quantity, l.Name)
+		if l.Course > 0 {
+			label = fmt.Sprintf("[C%d] %s", l.Course, label)
+		}
+		b.Line(label).Size(1, 1).Bold(false)
+		if l.Seat > 0 {
+			b.Line(fmt.Sprintf("    seat %d", l.Seat))
+		}
+		for _, m := range l.Modifiers {
+			b.Line("    + " + m)
+		}
+		if l.Note != "" {
+			b.Line("    * " + l.Note)
+		}
+		if len(l.Allergens) > 0 {
+			b.Text("    ").Invert(true).Bold(true).
+				Text(" ALLERGY: " + strings.ToUpper(strings.Join(l.Allergens, ", ")) + " ").
+				Bold(false).Invert(false).Line("")
+		}
+	}
+	return b.Rule().Feed(3).Cut().Bytes()
+}
+
+// QueueKitchen prints an order's lines on the kitchen printers at its
+// location, one ticket per printer, routed by product category. Lines no
+// kitchen printer takes are not printed.
+func QueueKitchen(ctx context.Context, o kds.Order) ([]Job, error) {
+	if len(o.Lines) == 0 {
+		return nil, nil
+	}
+	printers, err := printersFor(ctx, o.LocationID)
+	if err != nil || len(printers) == 0 {
+		return nil, err
+	}
+	infos, err := productInfos(ctx, o.Lines)
+	if err != nil {
+		return nil, err
+	}
+	byPrinter := map[int][]kitchenLine{}
+	var order []int
+	for _, l := range o.Lines {
+		info := infos[l.ProductID]
+		for _, i := range kitchenRoute(printers, info.Category) {
+			if _, ok := byPrinter[i]; !ok {
+				order = append(order, i)
+			}
+			byPrinter[i] = append(byPrinter[i], kitchenLine{OrderLine: l, Allergens: info.Allergens})
+		}
+	}
+	now := time.Now()
+	var jobs []Job
+	for _, i := range order {
+		job, err := Enqueue(ctx, printers[i].ID, JobKitchen, kitchenTicket(printers[i].Name, o, byPrinter[i], now), Ref{SaleID: o.SaleID, TabID: o.TabID})
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, nil
+}
+
+// ReceiptLine is a line on a customer receipt
+type ReceiptLine struct {
+	Name      string
+	Quantity  int
+	Modifiers []string
+	Total     money.Money
+}
+
+// ReceiptPayment is a payment on a customer receipt
+type ReceiptPayment struct {
+	Method string
+	Amount money.Money
+	Tip    money.Money
+}
+
+// ReceiptDiscount is a discount on a customer receipt
+type ReceiptDiscount struct {
+	Name   string
+	Amount money.Money
+}
+
+// Receipt is what a customer receipt shows
+type Receipt struct {
+	Header        []string
+	Number        string
+	At            time.Time
+	Staff         string
+	Lines         []ReceiptLine
+	Discounts     []ReceiptDiscount
+	Discount      money.Money
+	ServiceCharge money.Money
+	// Net, VAT and Total (gross) are shown the same way whether prices
+	// included VAT or had it added
+	Net      money.Money
+	VAT      money.Money
+	VATRate  float64
+	Total    money.Money
+	Payments []ReceiptPayment
+	// ExVAT marks prices that exclude VAT, so the lines are net
+	ExVAT  bool
+	Footer []string
+	// Copy marks a reprint
+	Copy bool
+}
+
+// receiptDoc lays out a customer receipt
+func receiptDoc(r Receipt) []byte {
+	b := NewBuilder()
+	b.Align(AlignCenter)
+	for i, h := range r.Header {
+		if i == 0 {
+			b.Bold(true).Size(2, 2).Line(h).Size(1, 1).Bold(false)
+			continue
+		}
+		b.Line(h)
+	}
+	if r.Copy {
+		b.Bold(true).Line("*** COPY ***").Bold(false)
+	}
+	b.Align(AlignLeft).Rule()
+	b.Columns(r.Number, r.At.Format("02/01/2006 15:04"))
+	if r.Staff != "" {
+		b.Line("Served by " + r.Staff)
+	}
+	b.Rule()
+	if r.ExVAT {
+		b.Line("Prices exclude VAT")
+	}
+	for _, l := range r.Lines {
+		b.Columns(fmt.Sprintf("%d x %s", l.Quantity, l.Name), l.Total.String())
+		for _, m := range l.Modifiers {
+			b.Line("    + " + m)
+		}
+	}
+	b.Rule()
+	for _, d := range r.Discounts {
+		name := d.Name
+		if name == "" {
+			name = "Discount"
+		}
+		b.Columns(name, "-"+d.Amount.String())
+	}
+	if len(r.Discounts) == 0 && r.Discount != 0 {
+		b.Columns("Discount", "-"+r.Discount.String())
+	}
+	if r.ServiceCharge != 0 {
+		b.Columns("Service charge", r.ServiceCharge.String())
+	}
+	vat := "VAT"
+	if r.VATRate > 0 {
+		vat = "VAT @ " + strconv.FormatFloat(r.VATRate, 'f', -1, 64) + "%"
+	}
+	b.Columns("Net", r.Net.String())
+	b.Columns(vat, r.VAT.String())
+	b.Bold(true).Size(1, 2).Columns("TOTAL", r.Total.String()).Size(1, 1).Bold(false)
+	for _, p := range r.Payments {
+		method := p.Method
+		if method != "" {
+			method = strings.ToUpper(method[:1]) + method[1:]
+		}
+		b.Columns(method, p.Amount.String())
+		if p.Tip != 0 {
+			b.Columns("  Tip", p.Tip.String())
+		}
+	}
+	b.Rule().Align(AlignCenter)
+	for _, f := range r.Footer {
+		b.Line(f)
+	}
+	return b.Feed(4).Cut().Bytes()
+}
+
+// ErrNoPrinter means a location has no receipt printer
+var ErrNoPrinter = errors.New("no receipt printer")
+
+// QueueReceipt prints a receipt on a printer, or with no printer given, on
+// the first receipt printer at the location
+func QueueReceipt(ctx context.Context, location, printer primitive.ObjectID, r Receipt, ref Ref) (*Job, error) {
+	if printer.IsZero() {
+		printers, err := printersFor(ctx, location)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range printers {
+			if p.Receipts {
+				printer = p.ID
+				break
+			}
+		}
+		if printer.IsZero() {
+			return nil, ErrNoPrinter
+		}
+	}
+	return Enqueue(ctx, printer, JobReceipt, receiptDoc(r), ref)
+}
+
+// testPage is printed to check a printer is set up
+func testPage(p *Printer) []byte {
+	b := NewBuilder()
+	b.Align(AlignCenter).Bold(true).Size(2, 2).Line("TEST PRINT").Size(1, 1).Bold(false)
+	b.Line(p.Name).Line(fmt.Sprintf("%s:%d", p.Host, p.Port))
+	b.Line(time.Now().Format("02/01/2006 15:04:05"))
+	b.Align(AlignLeft).Rule()
+	b.Text("Allergens: ").Invert(true).Text(" GLUTEN ").Invert(false).Line("")
+	return b.Feed(3).Cut().Bytes()
+}
@@ -0,0 +1,126 @@
+// Package printing lays out kitchen tickets and receipts as ESC/POS and sends
+// them to network printers through a queue that retries failed jobs.
+package printing
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ESC/POS control bytes
+const (
+	esc = 0x1b
+	gs  = 0x1d
+	lf  = 0x0a
+)
+
+// Text alignment
+const (
+	AlignLeft   = 0
+	AlignCenter = 1
+	AlignRight  = 2
+)
+
+// lineWidth is the characters per line of an 80mm printer in font A
+const lineWidth = 48
+
+// Builder builds an ESC/POS byte stream. Text is sent as-is, so it should
+// stay within the printer's code page.
+type Builder struct {
+	buf bytes.Buffer
+}
+
+// NewBuilder starts a document, resetting the printer
+func NewBuilder() *Builder {
+	b := &Builder{}
+	b.buf.Write([]byte{esc, '@'})
+	return b
+}
+
+func onOff(on bool) byte {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// Bold turns emphasised printing on or off
+func (b *Builder) Bold(on bool) *Builder {
+	b.buf.Write([]byte{esc, 'E', onOff(on)})
+	return b
+}
+
+// Invert turns white-on-black printing on or off
+func (b *Builder) Invert(on bool) *Builder {
+	b.buf.Write([]byte{gs, 'B', onOff(on)})
+	return b
+}
+
+// Size sets the character width and height multipliers, from 1 to 8
+func (b *Builder) Size(width, height int) *Builder {
+	clamp := func(n int) byte {
+		if n < 1 {
+			n = 1
+		}
+		if n > 8 {
+			n = 8
+		}
+		return byte(n - 1)
+	}
+	b.buf.Write([]byte{gs, '!', clamp(width)<<4 | clamp(height)})
+	return b
+}
+
+// Align sets the alignment of the lines that follow
+func (b *Builder) Align(a int) *Builder {
+	b.buf.Write([]byte{esc, 'a', byte(a)})
+	return b
+}
+
+// Text writes text without ending the line
+func (b *Builder) Text(s string) *Builder {
+	b.buf.WriteString(s)
+	return b
+}
+
+// Line writes a line of text
+func (b *Builder) Line(s string) *Builder {
+	b.buf.WriteString(s)
+	b.buf.WriteByte(lf)
+	return b
+}
+
+// Columns writes a line with left text and right text pushed to the edge,
+// truncating the left text if both don't fit
+func (b *Builder) Columns(left, right string) *Builder {
+	room := lineWidth - len(right) - 1
+	if room < 0 {
+		room = 0
+	}
+	if len(left) > room {
+		left = left[:room]
+	}
+	return b.Line(left + strings.Repeat(" ", lineWidth-len(left)-len(right)) + right)
+}
+
+// Rule writes a line of dashes across the paper
+func (b *Builder) Rule() *Builder {
+	return b.Line(strings.Repeat("-", lineWidth))
+}
+
+// Feed feeds n blank lines
+func (b *Builder) Feed(n int) *Builder {
+	b.buf.Write([]byte{esc, 'd', byte(n)})
+	return b
+}
+
+// Cut feeds the paper past the cutter and cuts it
+func (b *Builder) Cut() *Builder {
+	b.buf.Write([]byte{gs, 'V', 'A', 3})
+	return b
+}
+
+// Bytes returns the document
+func (b *Builder) Bytes() []byte {
+	return b.buf.Bytes()
+}
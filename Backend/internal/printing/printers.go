@@ -0,0 +1,240 @@
+package printing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const printersCollection = "printers"
+
+// defaultPort is the raw printing port network printers listen on
+const defaultPort = 9100
+
+// Printer statuses, from the last job sent to it
+const (
+	PrinterUnknown = "unknown"
+	PrinterOnline  = "online"
+	PrinterOffline = "offline"
+)
+
+// Printer is a network printer. Kitchen printers print the items in their
+// categories; one with no categories takes anything no other kitchen printer
+// at the location does. Receipt printers print customer receipts. A printer
+// with no location serves them all.
+type Printer struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name       string             `json:"name" bson:"name"`
+	Host       string             `json:"host" bson:"host"`
+	Port       int                `json:"port" bson:"port"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	Kitchen    bool               `json:"kitchen" bson:"kitchen"`
+	Categories []string           `json:"categories" bson:"categories"`
+	Receipts   bool               `json:"receipts" bson:"receipts"`
+	// Status, LastError and LastSeenAt are kept up to date by the queue
+	Status     string     `json:"status" bson:"status"`
+	LastError  string     `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty" bson:"lastSeenAt,omitempty"`
+}
+
+func (p *Printer) takes(category string) bool {
+	for _, c := range p.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// printersFor lists the printers serving a location
+func printersFor(ctx context.Context, location primitive.ObjectID) ([]Printer, error) {
+	coll, err := db.GetCollection(printersCollection)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"locationId": bson.M{"$exists": false}}
+	if !location.IsZero() {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"locationId": location}}}
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	printers := []Printer{}
+	err = cur.All(ctx, &printers)
+	return printers, err
+}
+
+// findPrinter loads one printer
+func findPrinter(ctx context.Context, id primitive.ObjectID) (*Printer, error) {
+	coll, err := db.GetCollection(printersCollection)
+	if err != nil {
+		return nil, err
+	}
+	var p Printer
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// decodePrinter reads a printer from a request body, filling in defaults
+func decodePrinter(r *http.Request) (*Printer, bool) {
+	var p Printer
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Name == "" || p.Host == "" {
+		return nil, false
+	}
+	if p.Port == 0 {
+		p.Port = defaultPort
+	}
+	if p.Categories == nil {
+		p.Categories = []string{}
+	}
+	p.Status, p.LastError, p.LastSeenAt = PrinterUnknown, "", nil
+	return &p, true
+}
+
+// PrintersHandler handles /api/printers, /api/printers/{id} and
+// POST /api/printers/{id}/test
+func PrintersHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(printersCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			loc, _ := primitive.ObjectIDFromHex(r.URL.Query().Get("locationId"))
+			printers, err := printersFor(ctx, loc)
+			if err != nil {
+				log.Printf("find error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(printers)
+		case http.MethodPost:
+			p, ok := decodePrinter(r)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"name and host required"}`))
+				return
+			}
+			p.ID = primitive.NewObjectID()
+			if _, err := coll.InsertOne(ctx, p); err != nil {
+				log.Printf("insert error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(p)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	if len(parts) == 4 && parts[3] == "test" && r.Method == http.MethodPost {
+		p, err := findPrinter(ctx, id)
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		} else if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		job, err := Enqueue(ctx, p.ID, JobTest, testPage(p), Ref{})
+		if err != nil {
+			log.Printf("print error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+	if len(parts) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		p, err := findPrinter(ctx, id)
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		} else if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	case http.MethodPut:
+		p, ok := decodePrinter(r)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"name and host required"}`))
+			return
+		}
+		p.ID = id
+		res, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, p)
+		if err != nil {
+			log.Printf("update error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.MatchedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	case http.MethodDelete:
+		res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			log.Printf("delete error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.DeletedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,310 @@
+package printing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const jobsCollection = "print_jobs"
+
+// Kinds of print job
+const (
+	JobKitchen = "kitchen"
+	JobReceipt = "receipt"
+	JobTest    = "test"
+)
+
+// Job statuses. A job waits in queued until sent; one that fails goes back
+// to queued until it has used its attempts, then stays failed until retried.
+const (
+	JobQueued   = "queued"
+	JobPrinting = "printing"
+	JobPrinted  = "printed"
+	JobFailed   = "failed"
+)
+
+const (
+	// maxAttempts is how many times a job is sent before it is failed
+	maxAttempts = 5
+	// retryDelay is the wait after the first failure; it doubles each time
+	retryDelay = 5 * time.Second
+	// sendTimeout bounds connecting to a printer and writing a job
+	sendTimeout = 10 * time.Second
+	// stuckAfter is how long a job can be printing before it is sent again,
+	// e.g. after the server restarted mid-job
+	stuckAfter = 2 * time.Minute
+	// workers is how many jobs are sent at once, so one printer that is off
+	// doesn't hold up the others
+	workers = 4
+)
+
+// Ref is what a job was printed for
+type Ref struct {
+	SaleID primitive.ObjectID `json:"saleId,omitempty" bson:"saleId,omitempty"`
+	TabID  primitive.ObjectID `json:"tabId,omitempty" bson:"tabId,omitempty"`
+}
+
+// Job is a document waiting for, or sent to, a printer
+type Job struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	PrinterID     primitive.ObjectID `json:"printerId" bson:"printerId"`
+	Kind          string             `json:"kind" bson:"kind"`
+	Ref           `bson:",inline"`
+	Data          []byte     `json:"-" bson:"data"`
+	Size          int        `json:"size" bson:"size"`
+	Status        string     `json:"status" bson:"status"`
+	Attempts      int        `json:"attempts" bson:"attempts"`
+	LastError     string     `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt" bson:"createdAt"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	PrintedAt     *time.Time `json:"printedAt,omitempty" bson:"printedAt,omitempty"`
+}
+
+// wake tells the worker a job is waiting
+var wake = make(chan struct{}, 1)
+
+func signal() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores a job for a printer and wakes the worker
+func Enqueue(ctx context.Context, printer primitive.ObjectID, kind string, data []byte, ref Ref) (*Job, error) {
+	coll, err := db.GetCollection(jobsCollection)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:            primitive.NewObjectID(),
+		PrinterID:     printer,
+		Kind:          kind,
+		Ref:           ref,
+		Data:          data,
+		Size:          len(data),
+		Status:        JobQueued,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if _, err := coll.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	signal()
+	return job, nil
+}
+
+// send writes a document to a printer's raw port
+func send(p *Printer, data []byte) error {
+	addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	conn, err := net.DialTimeout("tcp", addr, sendTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	_, err = conn.Write(data)
+	return err
+}
+
+// claim takes the next job that is due, marking it printing
+func claim(ctx context.Context) (*Job, error) {
+	coll, err := db.GetCollection(jobsCollection)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": JobQueued, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"status": JobPrinting, "startedAt": bson.M{"$lt": now.Add(-stuckAfter)}},
+	}}
+	update := bson.M{"$set": bson.M{"status": JobPrinting, "startedAt": now}, "$inc": bson.M{"attempts": 1}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	var job Job
+	if err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// deliver sends a claimed job and records how it went on the job and the
+// printer
+func deliver(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*sendTimeout)
+	defer cancel()
+	jobs, err := db.GetCollection(jobsCollection)
+	if err != nil {
+		log.Printf("[PRINT] db error: %v", err)
+		return
+	}
+	printers, err := db.GetCollection(printersCollection)
+	if err != nil {
+		log.Printf("[PRINT] db error: %v", err)
+		return
+	}
+	p, err := findPrinter(ctx, job.PrinterID)
+	if err == nil {
+		err = send(p, job.Data)
+	} else if err == mongo.ErrNoDocuments {
+		// A deleted printer can't come back; don't keep trying
+		job.Attempts = maxAttempts
+	}
+	now := time.Now()
+	if err == nil {
+		jobs.UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{
+			"$set":   bson.M{"status": JobPrinted, "printedAt": now},
+			"$unset": bson.M{"lastError": ""},
+		})
+		printers.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{
+			"$set":   bson.M{"status": PrinterOnline, "lastSeenAt": now},
+			"$unset": bson.M{"lastError": ""},
+		})
+		return
+	}
+	log.Printf("[PRINT] job %s attempt %d failed: %v", job.ID.Hex(), job.Attempts, err)
+	set := bson.M{"status": JobQueued, "lastError": err.Error(), "nextAttemptAt": now.Add(retryDelay << (job.Attempts - 1))}
+	if job.Attempts >= maxAttempts {
+		set["status"] = JobFailed
+	}
+	jobs.UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": set})
+	if p != nil {
+		printers.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"status": PrinterOffline, "lastError": err.Error()}})
+	}
+}
+
+// Start runs the print queue until ctx is done. Jobs are picked up as they
+// are queued, and retries when they fall due.
+func Start(ctx context.Context) {
+	slots := make(chan struct{}, workers)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		for {
+			slots <- struct{}{}
+			job, err := claim(ctx)
+			if err != nil {
+				<-slots
+				if err != mongo.ErrNoDocuments && ctx.Err() == nil {
+					log.Printf("[PRINT] queue error: %v", err)
+				}
+				break
+			}
+			go func() {
+				defer func() { <-slots }()
+				deliver(job)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-tick.C:
+		}
+	}
+}
+
+// JobsHandler handles GET /api/print-jobs?status=&printerId=,
+// GET /api/print-jobs/{id} and POST /api/print-jobs/{id}/retry
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(jobsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		filter := bson.M{}
+		if s := q.Get("status"); s != "" {
+			filter["status"] = s
+		}
+		if id, err := primitive.ObjectIDFromHex(q.Get("printerId")); err == nil {
+			filter["printerId"] = id
+		}
+		if id, err := primitive.ObjectIDFromHex(q.Get("saleId")); err == nil {
+			filter["saleId"] = id
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(200)
+		cur, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		jobs := []Job{}
+		if err := cur.All(ctx, &jobs); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	var job Job
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		err = coll.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	case len(parts) == 4 && parts[3] == "retry" && r.Method == http.MethodPost:
+		err = coll.FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "status": JobFailed},
+			bson.M{"$set": bson.M{"status": JobQueued, "attempts": 0, "nextAttemptAt": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			if n, _ := coll.CountDocuments(ctx, bson.M{"_id": id}); n > 0 {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error":"only failed jobs can be retried"}`))
+				return
+			}
+		}
+		signal()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
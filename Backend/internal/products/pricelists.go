@@ -0,0 +1,241 @@
+package products
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const priceListsCollection = "price_lists"
+
+// PriceList overrides product prices for some locations and times, e.g. a
+// happy hour or a higher price at an event venue. Empty LocationIDs, Days or
+// times mean no restriction. When several lists apply, the highest Priority
+// wins.
+type PriceList struct {
+	ID          primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	Name        string               `json:"name" bson:"name"`
+	Active      bool                 `json:"active" bson:"active"`
+	Priority    int                  `json:"priority" bson:"priority"`
+	LocationIDs []primitive.ObjectID `json:"locationIds" bson:"locationIds"`
+	// Days are weekdays, 0 = Sunday
+	Days []int `json:"days" bson:"days"`
+	// StartTime and EndTime are "15:04" local time; a window past midnight
+	// (e.g. 22:00-02:00) is allowed
+	StartTime string           `json:"startTime,omitempty" bson:"startTime,omitempty"`
+	EndTime   string           `json:"endTime,omitempty" bson:"endTime,omitempty"`
+	Prices    []PriceListEntry `json:"prices" bson:"prices"`
+}
+
+type PriceListEntry struct {
+	ProductID primitive.ObjectID `json:"productId" bson:"productId"`
+	Price     money.Money        `json:"price" bson:"price"`
+}
+
+// AppliesAt reports whether the list is in force at a location and time
+func (pl *PriceList) AppliesAt(location primitive.ObjectID, t time.Time) bool {
+	if !pl.Active {
+		return false
+	}
+	if len(pl.LocationIDs) > 0 {
+		found := false
+		for _, id := range pl.LocationIDs {
+			found = found || id == location
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(pl.Days) > 0 {
+		found := false
+		for _, d := range pl.Days {
+			found = found || time.Weekday(d) == t.Weekday()
+		}
+		if !found {
+			return false
+		}
+	}
+	if pl.StartTime == "" || pl.EndTime == "" {
+		return true
+	}
+	now := t.Format("15:04")
+	if pl.StartTime <= pl.EndTime {
+		return now >= pl.StartTime && now < pl.EndTime
+	}
+	return now >= pl.StartTime || now < pl.EndTime
+}
+
+// PriceOf returns the list's price for a product, if it has one
+func (pl *PriceList) PriceOf(productID primitive.ObjectID) (money.Money, bool) {
+	for _, e := range pl.Prices {
+		if e.ProductID == productID {
+			return e.Price, true
+		}
+	}
+	return 0, false
+}
+
+// ActivePriceList returns the highest priority list in force at a location
+// and time, or nil if none is.
+func ActivePriceList(ctx context.Context, location primitive.ObjectID, t time.Time) (*PriceList, error) {
+	coll, err := db.GetCollection(priceListsCollection)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := coll.Find(ctx, bson.M{"active": true})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var lists []PriceList
+	if err := cur.All(ctx, &lists); err != nil {
+		return nil, err
+	}
+	var best *PriceList
+	for i := range lists {
+		if lists[i].AppliesAt(location, t) && (best == nil || lists[i].Priority > best.Priority) {
+			best = &lists[i]
+		}
+	}
+	return best, nil
+}
+
+func validTime(s string) bool {
+	if s == "" {
+		return true
+	}
+	_, err := time.Parse("15:04", s)
+	return err == nil
+}
+
+// PriceListsHandler handles /api/price-lists and /api/price-lists/{id}
+func PriceListsHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(priceListsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	var id primitive.ObjectID
+	if len(parts) >= 3 {
+		if id, err = primitive.ObjectIDFromHex(parts[2]); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+	}
+	decode := func() (*PriceList, bool) {
+		var pl PriceList
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return nil, false
+		}
+		if pl.Name == "" || !validTime(pl.StartTime) || !validTime(pl.EndTime) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"name required and times must be HH:MM"}`))
+			return nil, false
+		}
+		if pl.LocationIDs == nil {
+			pl.LocationIDs = []primitive.ObjectID{}
+		}
+		if pl.Days == nil {
+			pl.Days = []int{}
+		}
+		if pl.Prices == nil {
+			pl.Prices = []PriceListEntry{}
+		}
+		return &pl, true
+	}
+	switch {
+	case id.IsZero() && r.Method == http.MethodGet:
+		cur, err := coll.Find(ctx, bson.M{})
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		lists := []PriceList{}
+		if err := cur.All(ctx, &lists); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lists)
+	case id.IsZero() && r.Method == http.MethodPost:
+		pl, ok := decode()
+		if !ok {
+			return
+		}
+		pl.ID = primitive.NewObjectID()
+		if _, err := coll.InsertOne(ctx, pl); err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pl)
+	case !id.IsZero() && r.Method == http.MethodGet:
+		var pl PriceList
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&pl); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pl)
+	case !id.IsZero() && r.Method == http.MethodPut:
+		pl, ok := decode()
+		if !ok {
+			return
+		}
+		pl.ID = id
+		res, err := coll.ReplaceOne(ctx, bson.M{"_id": id}, pl)
+		if err != nil {
+			log.Printf("update error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.MatchedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pl)
+	case !id.IsZero() && r.Method == http.MethodDelete:
+		res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			log.Printf("delete error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if res.DeletedCount == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,8 +17,39 @@ import (
 type Product struct {
 	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	Name     string             `json:"name" bson:"name"`
-	Price    float64            `json:"price" bson:"price"`
+	Price    money.Money        `json:"price" bson:"price"`
 	Category string             `json:"category,omitempty" bson:"category,omitempty"`
+	// Recipe lists the stock used by one unit sold. Products without a
+	// recipe deplete the inventory item linked to them one base unit at a time.
+	Recipe []RecipeLine `json:"recipe,omitempty" bson:"recipe,omitempty"`
+	// Modifiers are options that can be added to the product at a price,
+	// e.g. "extra shot" or "large"
+	Modifiers []Modifier `json:"modifiers,omitempty" bson:"modifiers,omitempty"`
+	// Allergens are printed on kitchen tickets, e.g. "gluten" or "nuts"
+	Allergens []string `json:"allergens,omitempty" bson:"allergens,omitempty"`
+}
+
+// Modifier is an option on a product; Price is added to the unit price
+type Modifier struct {
+	Name  string      `json:"name" bson:"name"`
+	Price money.Money `json:"price" bson:"price"`
+}
+
+// ModifierPrice returns the price of one of the product's modifiers
+func (p *Product) ModifierPrice(name string) (money.Money, bool) {
+	for _, m := range p.Modifiers {
+		if m.Name == name {
+			return m.Price, true
+		}
+	}
+	return 0, false
+}
+
+// RecipeLine is an amount of an inventory item, in any of the item's units
+type RecipeLine struct {
+	ItemID   primitive.ObjectID `json:"itemId" bson:"itemId"`
+	Quantity float64            `json:"qty" bson:"qty"`
+	Unit     string             `json:"unit,omitempty" bson:"unit,omitempty"`
 }
 
 // No in-memory products; use MongoDB
@@ -0,0 +1,187 @@
+package purchasing
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// exportOrder handles GET /api/purchase-orders/{id}/export?format=csv|pdf
+func exportOrder(ctx context.Context, w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	supplier, err := findSupplier(ctx, po.SupplierID)
+	if err != nil {
+		supplier = &Supplier{Name: "Unknown supplier"}
+	}
+	name := "PO-" + po.ID.Hex()
+	switch r.URL.Query().Get("format") {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Purchase Order", name})
+		cw.Write([]string{"Supplier", supplier.Name})
+		cw.Write([]string{"Status", po.Status})
+		cw.Write([]string{"Currency", po.Currency})
+		cw.Write([]string{})
+		cw.Write([]string{"Code", "Description", "Qty", "Unit", "Unit Cost", "Line Total"})
+		for _, l := range po.Lines {
+			cw.Write([]string{
+				l.Code,
+				l.Description,
+				strconv.FormatFloat(l.Quantity, 'f', -1, 64),
+				l.Unit,
+				l.UnitCost.String(),
+				l.Total().String(),
+			})
+		}
+		cw.Write([]string{"", "", "", "", "Total", po.Total().String()})
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("csv export error: %v", err)
+		}
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.pdf"`)
+		w.Write(orderPDF(ctx, name, supplier, po))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"format must be csv or pdf"}`))
+	}
+}
+
+// orderPDF lays the order out as monospaced text lines
+func orderPDF(ctx context.Context, name string, supplier *Supplier, po *PurchaseOrder) []byte {
+	var lines []string
+	if company := companyName(ctx); company != "" {
+		lines = append(lines, company, "")
+	}
+	lines = append(lines,
+		"PURCHASE ORDER "+name,
+		"Date: "+po.CreatedAt.Format("02 Jan 2006"),
+		"",
+		"To: "+supplier.Name,
+	)
+	if supplier.ContactName != "" {
+		lines = append(lines, "Attn: "+supplier.ContactName)
+	}
+	for _, a := range strings.Split(supplier.Address, "\n") {
+		if a = strings.TrimSpace(a); a != "" {
+			lines = append(lines, "    "+a)
+		}
+	}
+	lines = append(lines, "",
+		fmt.Sprintf("%-12s %-27s %6s %-6s %10s %11s", "Code", "Description", "Qty", "Unit", "Cost", "Total"),
+		strings.Repeat("-", 77),
+	)
+	for _, l := range po.Lines {
+		lines = append(lines, fmt.Sprintf("%-12.12s %-27.27s %6g %-6.6s %10s %11s",
+			l.Code, l.Description, l.Quantity, l.Unit, l.UnitCost, l.Total()))
+	}
+	lines = append(lines, strings.Repeat("-", 77),
+		fmt.Sprintf("%65s %11s", strings.TrimSpace("Total "+po.Currency), po.Total()))
+	if po.Notes != "" {
+		lines = append(lines, "", "Notes: "+po.Notes)
+	}
+	return textPDF(lines)
+}
+
+func companyName(ctx context.Context) string {
+	coll, err := db.GetCollection("business")
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		CompanyName string `bson:"companyName"`
+	}
+	if err := coll.FindOne(ctx, bson.M{}).Decode(&info); err != nil {
+		return ""
+	}
+	return info.CompanyName
+}
+
+// textPDF renders lines of plain text onto A4 pages in Courier. It produces a
+// minimal but valid PDF without pulling in a PDF library.
+func textPDF(lines []string) []byte {
+	const (
+		perPage  = 60
+		fontSize = 9
+		leading  = 12
+		top      = 800
+		left     = 40
+	)
+	var pages [][]string
+	for len(lines) > perPage {
+		pages = append(pages, lines[:perPage])
+		lines = lines[perPage:]
+	}
+	pages = append(pages, lines)
+
+	// Object numbers: 1 catalog, 2 page tree, 3 font, then a page and a
+	// content stream per page
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", fontSize, leading, left, top)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape escapes a string for a PDF literal and drops characters the
+// standard Courier encoding cannot show
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '£':
+			b.WriteString("\\243")
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,398 @@
+package purchasing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hospos-backend/internal/business"
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/inventory"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Purchase order states
+const (
+	StatusDraft             = "draft"
+	StatusSent              = "sent"
+	StatusPartiallyReceived = "partially_received"
+	StatusReceived          = "received"
+)
+
+type OrderLine struct {
+	ItemID      primitive.ObjectID `json:"itemId" bson:"itemId"`
+	Code        string             `json:"code" bson:"code"`
+	Description string             `json:"description" bson:"description"`
+	// Quantity, Received and UnitCost are in Unit, the item's purchase unit
+	// (e.g. "case"); blank means the item's base unit
+	Quantity float64     `json:"qty" bson:"qty"`
+	Received float64     `json:"received" bson:"received"`
+	Unit     string      `json:"unit,omitempty" bson:"unit,omitempty"`
+	UnitCost money.Money `json:"unitCost" bson:"unitCost"`
+}
+
+// Total is the line's value at the ordered quantity
+func (l OrderLine) Total() money.Money {
+	return l.UnitCost.ForQty(l.Quantity, 1, money.HalfUp)
+}
+
+type PurchaseOrder struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SupplierID primitive.ObjectID `json:"supplierId" bson:"supplierId"`
+	Status     string             `json:"status" bson:"status"`
+	Lines      []OrderLine        `json:"lines" bson:"lines"`
+	Notes      string             `json:"notes" bson:"notes"`
+	// Currency is the code the costs are in, the business's when ordered
+	Currency   string     `json:"currency" bson:"currency"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	SentAt     *time.Time `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+	ExpectedAt *time.Time `json:"expectedAt,omitempty" bson:"expectedAt,omitempty"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty" bson:"receivedAt,omitempty"`
+}
+
+// Total is the order value at the ordered quantities
+func (po *PurchaseOrder) Total() money.Money {
+	var total money.Money
+	for _, l := range po.Lines {
+		total += l.Total()
+	}
+	return total
+}
+
+// receiveRequest is the body of POST /api/purchase-orders/{id}/receive
+type receiveRequest struct {
+	User  string `json:"user"`
+	Lines []struct {
+		Line     int         `json:"line"` // index into the order's lines
+		Quantity float64     `json:"qty"`
+		UnitCost money.Money `json:"unitCost"` // optional; defaults to the ordered cost
+		// Batch and BestBefore are optional lot details for perishables
+		Batch      string     `json:"batch"`
+		BestBefore *time.Time `json:"bestBefore"`
+	} `json:"lines"`
+}
+
+// PurchaseOrdersHandler handles /api/purchase-orders and its sub-routes
+func PurchaseOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection("purchase_orders")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) >= 3 && parts[2] != "" {
+		id, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		var po PurchaseOrder
+		if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&po); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+			return
+		}
+		action := ""
+		if len(parts) > 3 {
+			action = parts[3]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(po)
+		case action == "" && r.Method == http.MethodPut:
+			updateOrder(ctx, w, r, &po)
+		case action == "send" && r.Method == http.MethodPost:
+			sendOrder(ctx, w, &po)
+		case action == "receive" && r.Method == http.MethodPost:
+			receiveOrder(ctx, w, r, &po)
+		case action == "export" && r.Method == http.MethodGet:
+			exportOrder(ctx, w, r, &po)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		filter := bson.M{}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filter["status"] = status
+		}
+		if supplier := r.URL.Query().Get("supplierId"); supplier != "" {
+			if oid, err := primitive.ObjectIDFromHex(supplier); err == nil {
+				filter["supplierId"] = oid
+			}
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+		cur, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		orders := []PurchaseOrder{}
+		if err := cur.All(ctx, &orders); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orders)
+	case http.MethodPost:
+		var po PurchaseOrder
+		if err := json.NewDecoder(r.Body).Decode(&po); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		supplier, err := findSupplier(ctx, po.SupplierID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unknown supplier"}`))
+			return
+		}
+		if !fillLines(w, supplier, po.Lines) {
+			return
+		}
+		po.ID = primitive.NewObjectID()
+		po.Status = StatusDraft
+		po.Currency = business.Currency(ctx)
+		po.CreatedAt = time.Now()
+		po.SentAt, po.ExpectedAt, po.ReceivedAt = nil, nil, nil
+		if _, err := coll.InsertOne(ctx, po); err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(po)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func findSupplier(ctx context.Context, id primitive.ObjectID) (*Supplier, error) {
+	coll, err := db.GetCollection("suppliers")
+	if err != nil {
+		return nil, err
+	}
+	var s Supplier
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// fillLines validates order lines and fills in the supplier's code and cost
+// where the caller left them blank. It writes the error response itself.
+func fillLines(w http.ResponseWriter, supplier *Supplier, lines []OrderLine) bool {
+	if len(lines) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"order has no lines"}`))
+		return false
+	}
+	for i := range lines {
+		l := &lines[i]
+		if l.ItemID.IsZero() || l.Quantity <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"each line needs an itemId and a positive qty"}`))
+			return false
+		}
+		l.Received = 0
+		if sp, ok := supplier.productFor(l.ItemID); ok {
+			if l.Code == "" {
+				l.Code = sp.Code
+			}
+			if l.Unit == "" {
+				l.Unit = sp.Unit
+			}
+			if l.UnitCost == 0 {
+				l.UnitCost = sp.UnitCost
+			}
+		}
+	}
+	return true
+}
+
+// updateOrder replaces the lines and notes of a draft order
+func updateOrder(ctx context.Context, w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	var req PurchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	supplier, err := findSupplier(ctx, po.SupplierID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"unknown supplier"}`))
+		return
+	}
+	if !fillLines(w, supplier, req.Lines) {
+		return
+	}
+	coll, err := db.GetCollection("purchase_orders")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": po.ID, "status": StatusDraft},
+		bson.M{"$set": bson.M{"lines": req.Lines, "notes": req.Notes}})
+	if err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if res.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"only draft orders can be edited"}`))
+		return
+	}
+	po.Lines, po.Notes = req.Lines, req.Notes
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// sendOrder marks a draft as sent and works out when to expect it
+func sendOrder(ctx context.Context, w http.ResponseWriter, po *PurchaseOrder) {
+	now := time.Now()
+	expected := now
+	if supplier, err := findSupplier(ctx, po.SupplierID); err == nil {
+		expected = now.AddDate(0, 0, supplier.LeadTimeDays)
+	}
+	coll, err := db.GetCollection("purchase_orders")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	res, err := coll.UpdateOne(ctx,
+		bson.M{"_id": po.ID, "status": StatusDraft},
+		bson.M{"$set": bson.M{"status": StatusSent, "sentAt": now, "expectedAt": expected}})
+	if err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if res.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"only draft orders can be sent"}`))
+		return
+	}
+	po.Status, po.SentAt, po.ExpectedAt = StatusSent, &now, &expected
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// receiveOrder books delivered lines into stock. Each delivery creates receipt
+// movements and updates the items' unit costs.
+func receiveOrder(ctx context.Context, w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	if po.Status != StatusSent && po.Status != StatusPartiallyReceived {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"order is not awaiting delivery"}`))
+		return
+	}
+	var req receiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	if len(req.Lines) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"nothing to receive"}`))
+		return
+	}
+	for _, rl := range req.Lines {
+		if rl.Line < 0 || rl.Line >= len(po.Lines) || rl.Quantity <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid line or qty"}`))
+			return
+		}
+	}
+	coll, err := db.GetCollection("purchase_orders")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	for _, rl := range req.Lines {
+		line := &po.Lines[rl.Line]
+		cost := rl.UnitCost
+		if cost == 0 {
+			cost = line.UnitCost
+		}
+		m := &inventory.StockMovement{
+			ItemID:     line.ItemID,
+			Quantity:   rl.Quantity,
+			Unit:       line.Unit,
+			Batch:      rl.Batch,
+			BestBefore: rl.BestBefore,
+			User:       req.User,
+			Reference:  po.ID.Hex(),
+		}
+		if err := inventory.ReceiveStock(ctx, m, cost); err != nil {
+			log.Printf("receive error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"stock error"}`))
+			return
+		}
+		field := "lines." + strconv.Itoa(rl.Line)
+		update := bson.M{"$inc": bson.M{field + ".received": rl.Quantity}}
+		if rl.UnitCost != 0 {
+			update["$set"] = bson.M{field + ".unitCost": rl.UnitCost}
+			line.UnitCost = rl.UnitCost
+		}
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": po.ID}, update); err != nil {
+			log.Printf("update error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		line.Received += rl.Quantity
+	}
+	po.Status = StatusReceived
+	for _, l := range po.Lines {
+		if l.Received < l.Quantity {
+			po.Status = StatusPartiallyReceived
+		}
+	}
+	set := bson.M{"status": po.Status}
+	if po.Status == StatusReceived {
+		now := time.Now()
+		po.ReceivedAt = &now
+		set["receivedAt"] = now
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": po.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("update error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
@@ -0,0 +1,174 @@
+package purchasing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SupplierProduct maps an inventory item to the supplier's own product code
+type SupplierProduct struct {
+	ItemID   primitive.ObjectID `json:"itemId" bson:"itemId"`
+	Code     string             `json:"code" bson:"code"`
+	Unit     string             `json:"unit,omitempty" bson:"unit,omitempty"` // purchase unit, e.g. "case"
+	UnitCost money.Money        `json:"unitCost" bson:"unitCost"`
+}
+
+type Supplier struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name         string             `json:"name" bson:"name"`
+	ContactName  string             `json:"contactName" bson:"contactName"`
+	Email        string             `json:"email" bson:"email"`
+	Phone        string             `json:"phone" bson:"phone"`
+	Address      string             `json:"address" bson:"address"`
+	LeadTimeDays int                `json:"leadTimeDays" bson:"leadTimeDays"`
+	Products     []SupplierProduct  `json:"products" bson:"products"`
+	Notes        string             `json:"notes" bson:"notes"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// productFor returns the supplier's entry for an inventory item, if any
+func (s *Supplier) productFor(itemID primitive.ObjectID) (SupplierProduct, bool) {
+	for _, p := range s.Products {
+		if p.ItemID == itemID {
+			return p, true
+		}
+	}
+	return SupplierProduct{}, false
+}
+
+// SuppliersHandler handles /api/suppliers and /api/suppliers/{id}
+func SuppliersHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection("suppliers")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 3 && parts[2] != "" {
+		id, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var s Supplier
+			if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s)
+		case http.MethodPut:
+			var s Supplier
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid input"}`))
+				return
+			}
+			update := bson.M{"$set": bson.M{
+				"name":         s.Name,
+				"contactName":  s.ContactName,
+				"email":        s.Email,
+				"phone":        s.Phone,
+				"address":      s.Address,
+				"leadTimeDays": s.LeadTimeDays,
+				"products":     s.Products,
+				"notes":        s.Notes,
+			}}
+			res, err := coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+			if err != nil {
+				log.Printf("update error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			if res.MatchedCount == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"success":true}`))
+		case http.MethodDelete:
+			res, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+			if err != nil {
+				log.Printf("delete error: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"db error"}`))
+				return
+			}
+			if res.DeletedCount == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"not found"}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cur, err := coll.Find(ctx, bson.M{})
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		suppliers := []Supplier{}
+		if err := cur.All(ctx, &suppliers); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suppliers)
+	case http.MethodPost:
+		var s Supplier
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		if s.Name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"name required"}`))
+			return
+		}
+		s.ID = primitive.NewObjectID()
+		s.CreatedAt = time.Now()
+		if s.Products == nil {
+			s.Products = []SupplierProduct{}
+		}
+		if _, err := coll.InsertOne(ctx, s); err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -16,7 +16,24 @@ import (
 type Receipt struct {
 	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	SaleID primitive.ObjectID `json:"sale_id" bson:"sale_id"`
-	Detail string             `json:"detail" bson:"detail"`
+	// SaleNumber is copied from the sale so it can be printed
+	SaleNumber string `json:"saleNumber,omitempty" bson:"saleNumber,omitempty"`
+	Detail     string `json:"detail" bson:"detail"`
+}
+
+// saleNumber looks up the human-readable number of a sale
+func saleNumber(ctx context.Context, saleID primitive.ObjectID) string {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return ""
+	}
+	var sale struct {
+		Number string `bson:"number"`
+	}
+	if err := coll.FindOne(ctx, bson.M{"_id": saleID}).Decode(&sale); err != nil {
+		return ""
+	}
+	return sale.Number
 }
 
 // No in-memory receipts; use MongoDB
@@ -68,6 +85,7 @@ func ReceiptsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
+		rc.SaleNumber = saleNumber(ctx, rc.SaleID)
 		res, err := coll.InsertOne(ctx, rc)
 		if err != nil {
 			log.Printf("insert error: %v", err)
@@ -0,0 +1,168 @@
+package sales
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/discounts"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DiscountRefs are the discounts asked for on a sale, by ID or by the code
+// the customer gave. DiscountID is the single discount older tills send.
+type DiscountRefs struct {
+	DiscountID    primitive.ObjectID   `json:"discountId,omitempty" bson:"discountId,omitempty"`
+	DiscountIDs   []primitive.ObjectID `json:"discountIds,omitempty" bson:"discountIds,omitempty"`
+	DiscountCodes []string             `json:"discountCodes,omitempty" bson:"discountCodes,omitempty"`
+}
+
+// IsZero reports whether no discount is asked for
+func (r DiscountRefs) IsZero() bool {
+	return r.DiscountID.IsZero() && len(r.DiscountIDs) == 0 && len(r.DiscountCodes) == 0
+}
+
+// AppliedDiscount is a discount taken off a sale and what it came off
+type AppliedDiscount struct {
+	DiscountID primitive.ObjectID `json:"discountId" bson:"discountId"`
+	Name       string             `json:"name" bson:"name"`
+	Code       string             `json:"code,omitempty" bson:"code,omitempty"`
+	Scope      string             `json:"scope" bson:"scope"`
+	Percent    float64            `json:"percent" bson:"percent"`
+	Amount     money.Money        `json:"amount" bson:"amount"`
+	Lines      []DiscountLine     `json:"lines" bson:"lines"`
+}
+
+// DiscountLine is the part of a discount that came off one sale line
+type DiscountLine struct {
+	Line   int         `json:"line" bson:"line"`
+	Amount money.Money `json:"amount" bson:"amount"`
+}
+
+// DiscountError is a discount asked for that can't be applied. It wraps
+// ErrInvalidDiscount.
+type DiscountError struct {
+	// Ref is the ID or code asked for
+	Ref string
+	Msg string
+}
+
+func (e *DiscountError) Error() string { return e.Msg }
+
+func (e *DiscountError) Unwrap() error { return ErrInvalidDiscount }
+
+// findDiscounts loads the discounts asked for, each once, and checks they
+// are active and unexpired at now. Codes match whatever their case.
+func findDiscounts(ctx context.Context, refs DiscountRefs, now time.Time) ([]discounts.Discount, error) {
+	if refs.IsZero() {
+		return nil, nil
+	}
+	coll, err := db.GetCollection("discounts")
+	if err != nil {
+		return nil, err
+	}
+	var found []discounts.Discount
+	seen := map[primitive.ObjectID]bool{}
+	add := func(filter bson.M, ref, notFound string) error {
+		var d discounts.Discount
+		// An active discount wins over an old one with the same code
+		opts := options.FindOne().SetSort(bson.D{{Key: "active", Value: -1}})
+		if err := coll.FindOne(ctx, filter, opts).Decode(&d); err == mongo.ErrNoDocuments {
+			return &DiscountError{Ref: ref, Msg: notFound}
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case d.Expired(now):
+			return &DiscountError{Ref: ref, Msg: "discount " + ref + " has expired"}
+		case !d.Active:
+			return &DiscountError{Ref: ref, Msg: "discount " + ref + " is not active"}
+		case d.Percent <= 0 || d.Percent > 100:
+			return &DiscountError{Ref: ref, Msg: "discount " + ref + " has no valid percent"}
+		}
+		if !seen[d.ID] {
+			seen[d.ID] = true
+			found = append(found, d)
+		}
+		return nil
+	}
+	ids := refs.DiscountIDs
+	if !refs.DiscountID.IsZero() {
+		ids = append([]primitive.ObjectID{refs.DiscountID}, ids...)
+	}
+	for _, id := range ids {
+		if err := add(bson.M{"_id": id}, id.Hex(), "discount not found"); err != nil {
+			return nil, err
+		}
+	}
+	for _, code := range refs.DiscountCodes {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		filter := bson.M{"code": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(code) + "$", Options: "i"}}
+		if err := add(filter, code, "unknown discount code "+code); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// applyDiscounts takes the discounts off the sale's lines and records each
+// one. Line discounts come off first, from the lines they cover; basket
+// discounts then come off what is left, shared across the lines in
+// proportion to their value so every penny is put against a line.
+func applyDiscounts(s *Sale, ds []discounts.Discount) error {
+	s.Discount, s.Discounts = 0, nil
+	for i := range s.Products {
+		s.Products[i].Discount = 0
+	}
+	sort.SliceStable(ds, func(i, j int) bool { return ds[i].LineLevel() && !ds[j].LineLevel() })
+	for _, d := range ds {
+		ad := AppliedDiscount{DiscountID: d.ID, Name: d.Name, Code: d.Code, Scope: discounts.ScopeBasket, Percent: d.Percent, Lines: []DiscountLine{}}
+		if d.LineLevel() {
+			ad.Scope = discounts.ScopeLine
+			for i := range s.Products {
+				p := &s.Products[i]
+				if !d.AppliesTo(p.ProductID, p.category) {
+					continue
+				}
+				ad.Lines = append(ad.Lines, DiscountLine{Line: i, Amount: (p.LineTotal - p.Discount).Percent(d.Percent, discountRounding())})
+			}
+			if len(ad.Lines) == 0 {
+				ref := d.Code
+				if ref == "" {
+					ref = d.ID.Hex()
+				}
+				return &DiscountError{Ref: ref, Msg: "discount " + ref + " doesn't apply to anything in the sale"}
+			}
+		} else {
+			var left money.Money
+			weights := make([]float64, len(s.Products))
+			for i, p := range s.Products {
+				left += p.LineTotal - p.Discount
+				weights[i] = (p.LineTotal - p.Discount).Float()
+			}
+			for i, share := range money.Allocate(left.Percent(d.Percent, discountRounding()), weights) {
+				if share != 0 {
+					ad.Lines = append(ad.Lines, DiscountLine{Line: i, Amount: share})
+				}
+			}
+		}
+		for _, l := range ad.Lines {
+			s.Products[l.Line].Discount += l.Amount
+			ad.Amount += l.Amount
+		}
+		s.Discount += ad.Amount
+		s.Discounts = append(s.Discounts, ad)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package sales
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"hospos-backend/internal/business"
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/locations"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/products"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Limits on a single sale line
+const maxLineQty = 999
+
+// standardVATRate is used when the business has no default tax rate set
+const standardVATRate = 20.0
+
+var (
+	ErrInvalidLine     = errors.New("invalid sale line")
+	ErrInvalidDiscount = errors.New("discount not found, inactive or expired")
+)
+
+// PricingError explains why a sale could not be priced
+type PricingError struct {
+	Line int
+	Err  error
+	Msg  string
+}
+
+func (e *PricingError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func (e *PricingError) Unwrap() error { return e.Err }
+
+// Figures are the money totals of a sale
+type Figures struct {
+	Total         money.Money `json:"total" bson:"total"`
+	VAT           money.Money `json:"vat" bson:"vat"`
+	Discount      money.Money `json:"discount" bson:"discount"`
+	ServiceCharge money.Money `json:"serviceCharge,omitempty" bson:"serviceCharge,omitempty"`
+}
+
+// priceTolerance is how far the till's figures may drift from the server's
+// before the sale is treated as a mismatch. PRICE_TOLERANCE overrides it.
+func priceTolerance() money.Money {
+	if v, err := money.Parse(os.Getenv("PRICE_TOLERANCE")); err == nil && v >= 0 {
+		return v
+	}
+	return 1
+}
+
+// rejectMismatches reports whether mismatched sales are refused rather than
+// stored with the server's figures and flagged (PRICE_MISMATCH=reject|flag).
+func rejectMismatches() bool {
+	return os.Getenv("PRICE_MISMATCH") == "reject"
+}
+
+// vatRounding is how VAT is rounded to the penny: half up unless
+// VAT_ROUNDING says otherwise.
+func vatRounding() money.Rounding {
+	return money.RoundingFromEnv("VAT_ROUNDING", money.HalfUp)
+}
+
+// discountRounding is how percentages of a bill, discounts and service
+// charges, are rounded: half to even (banker's) unless DISCOUNT_ROUNDING says
+// otherwise, so halfpennies don't always fall the same way.
+func discountRounding() money.Rounding {
+	return money.RoundingFromEnv("DISCOUNT_ROUNDING", money.HalfEven)
+}
+
+// priceSale replaces the till's prices and totals with the server's: the lines
+// are priced by PriceLines, the discount is worked out from the discounts
+// asked for, and VAT is taken out of the total or added to it by the pricing
+// mode in force. It returns the figures the till sent.
+func priceSale(ctx context.Context, s *Sale, now time.Time) (Figures, error) {
+	sent := Figures{Total: s.Total, VAT: s.VAT, Discount: s.Discount, ServiceCharge: s.ServiceCharge}
+	if len(s.Products) == 0 {
+		return sent, &PricingError{Line: -1, Err: ErrInvalidLine, Msg: "sale has no lines"}
+	}
+	priceList, err := PriceLines(ctx, s.LocationID, now, s.Products)
+	if err != nil {
+		return sent, err
+	}
+	s.PriceListID = primitive.NilObjectID
+	if priceList != nil {
+		s.PriceListID = priceList.ID
+	}
+	s.Subtotal = 0
+	for _, line := range s.Products {
+		s.Subtotal += line.LineTotal
+	}
+
+	ds, err := findDiscounts(ctx, s.DiscountRefs, now)
+	if err != nil {
+		return sent, err
+	}
+	if err := applyDiscounts(s, ds); err != nil {
+		return sent, err
+	}
+	goods := s.Subtotal - s.Discount
+	loc, err := locations.Get(ctx, s.LocationID)
+	if err != nil {
+		return sent, err
+	}
+	vatable := applyServiceCharge(s, loc, goods)
+	biz := businessPricing(ctx, loc)
+	s.Currency, s.PricingMode, s.VATRate = biz.Currency, biz.Mode, biz.VATRate
+	if biz.Mode == business.PricingExclusive {
+		// Prices are net; VAT goes on top
+		s.Net = goods + s.ServiceCharge
+		s.VAT = vatable.TaxOn(biz.VATRate, vatRounding())
+		s.Total = s.Net + s.VAT
+	} else {
+		// Prices include VAT, 1/6 of them at 20%
+		s.Total = goods + s.ServiceCharge
+		s.VAT = vatable.TaxIn(biz.VATRate, vatRounding())
+		s.Net = s.Total - s.VAT
+	}
+
+	s.Paid, s.Tips = 0, 0
+	for _, p := range s.Payments {
+		if p.Tip < 0 {
+			return sent, &PricingError{Line: -1, Err: ErrInvalidLine, Msg: "tips can't be negative"}
+		}
+		s.Paid += p.Amount
+		s.Tips += p.Tip
+	}
+	return sent, nil
+}
+
+// PriceLines fills in each line's name, unit price and line total from its
+// product, the price list in force and its modifiers. Lines with an OrderedAt
+// time use the price list in force then; the rest use the one at now, which
+// is returned.
+func PriceLines(ctx context.Context, location primitive.ObjectID, now time.Time, lines []SaleProduct) (*products.PriceList, error) {
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		return nil, err
+	}
+	lists := map[time.Time]*products.PriceList{}
+	listAt := func(t time.Time) (*products.PriceList, error) {
+		if pl, ok := lists[t]; ok {
+			return pl, nil
+		}
+		pl, err := products.ActivePriceList(ctx, location, t)
+		if err == nil {
+			lists[t] = pl
+		}
+		return pl, err
+	}
+	current, err := listAt(now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range lines {
+		line := &lines[i]
+		if line.Quantity < 1 || line.Quantity > maxLineQty {
+			return nil, &PricingError{Line: i, Err: ErrInvalidLine, Msg: fmt.Sprintf("qty must be between 1 and %d", maxLineQty)}
+		}
+		priceList := current
+		if line.OrderedAt != nil {
+			if priceList, err = listAt(*line.OrderedAt); err != nil {
+				return nil, err
+			}
+		}
+		var p products.Product
+		if err := coll.FindOne(ctx, bson.M{"_id": line.ProductID}).Decode(&p); err == mongo.ErrNoDocuments {
+			return nil, &PricingError{Line: i, Err: ErrInvalidLine, Msg: "unknown product"}
+		} else if err != nil {
+			return nil, err
+		}
+		unit := p.Price
+		if priceList != nil {
+			if price, ok := priceList.PriceOf(p.ID); ok {
+				unit = price
+			}
+		}
+		for _, name := range line.Modifiers {
+			extra, ok := p.ModifierPrice(name)
+			if !ok {
+				return nil, &PricingError{Line: i, Err: ErrInvalidLine, Msg: "unknown modifier " + name}
+			}
+			unit += extra
+		}
+		line.Name = p.Name
+		line.category = p.Category
+		line.Price = unit
+		line.LineTotal = unit.Times(line.Quantity)
+	}
+	return current, nil
+}
+
+// applyServiceCharge works out the sale's service charge on the goods total
+// from its location's settings: added when asked for or when the party is
+// big enough, unless waived. It returns the amount VAT is charged on, which
+// leaves out a discretionary charge.
+func applyServiceCharge(s *Sale, loc *locations.Location, goods money.Money) money.Money {
+	s.ServiceCharge = 0
+	if loc == nil || loc.ServiceChargePercent <= 0 {
+		return goods
+	}
+	apply := loc.ServiceChargeMinCovers > 0 && s.Covers >= loc.ServiceChargeMinCovers
+	if s.ApplyServiceCharge != nil {
+		apply = *s.ApplyServiceCharge
+	}
+	if !apply {
+		return goods
+	}
+	s.ServiceCharge = goods.Percent(loc.ServiceChargePercent, discountRounding())
+	if loc.ServiceChargeVATable {
+		return goods + s.ServiceCharge
+	}
+	return goods
+}
+
+// mismatch reports whether the till's figures differ from the server's by
+// more than the tolerance. VAT and service charge are only compared when the
+// till sent them.
+func mismatch(sent, server Figures) bool {
+	tol := priceTolerance()
+	if (sent.Total-server.Total).Abs() > tol || (sent.Discount-server.Discount).Abs() > tol {
+		return true
+	}
+	if sent.ServiceCharge != 0 && (sent.ServiceCharge-server.ServiceCharge).Abs() > tol {
+		return true
+	}
+	return sent.VAT != 0 && (sent.VAT-server.VAT).Abs() > tol
+}
+
+// pricingInfo is what pricing needs from the business settings
+type pricingInfo struct {
+	// VATRate is the default tax rate as a percentage
+	VATRate  float64
+	Currency string
+	// Mode is whether prices include VAT (inclusive) or not (exclusive)
+	Mode string
+}
+
+// businessPricing reads the business's tax rate, currency and pricing mode,
+// falling back to the standard rate, the default currency and inclusive
+// prices. A location's pricing mode overrides the business's.
+func businessPricing(ctx context.Context, loc *locations.Location) pricingInfo {
+	info := pricingInfo{VATRate: standardVATRate, Currency: money.DefaultCurrency, Mode: business.PricingInclusive}
+	var biz struct {
+		Currency       string  `bson:"currency"`
+		DefaultTaxRate float64 `bson:"defaultTaxRate"`
+		PricingMode    string  `bson:"pricingMode"`
+	}
+	if coll, err := db.GetCollection("business"); err == nil && coll.FindOne(ctx, bson.M{}).Decode(&biz) == nil {
+		if biz.DefaultTaxRate > 0 {
+			info.VATRate = biz.DefaultTaxRate
+		}
+		if biz.Currency != "" {
+			info.Currency = biz.Currency
+		}
+		if biz.PricingMode != "" {
+			info.Mode = biz.PricingMode
+		}
+	}
+	if loc != nil && loc.PricingMode != "" {
+		info.Mode = loc.PricingMode
+	}
+	return info
+}
@@ -0,0 +1,102 @@
+package sales
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"hospos-backend/internal/business"
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/printing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// receiptFor lays out a sale as a customer receipt, headed and footed with
+// the business details
+func receiptFor(ctx context.Context, s *Sale) printing.Receipt {
+	rc := printing.Receipt{
+		Number:        s.Number,
+		At:            s.CreatedAt,
+		Staff:         s.UserName,
+		Discount:      s.Discount,
+		ServiceCharge: s.ServiceCharge,
+		Net:           s.Net,
+		VAT:           s.VAT,
+		VATRate:       s.VATRate,
+		Total:         s.Total,
+		ExVAT:         s.PricingMode == business.PricingExclusive,
+	}
+	if rc.Net == 0 {
+		// Sales from before net was recorded
+		rc.Net = s.Total - s.VAT
+	}
+	for _, p := range s.Products {
+		rc.Lines = append(rc.Lines, printing.ReceiptLine{Name: p.Name, Quantity: p.Quantity, Modifiers: p.Modifiers, Total: p.LineTotal})
+	}
+	for _, d := range s.Discounts {
+		rc.Discounts = append(rc.Discounts, printing.ReceiptDiscount{Name: d.Name, Amount: d.Amount})
+	}
+	for _, p := range s.Payments {
+		rc.Payments = append(rc.Payments, printing.ReceiptPayment{Method: p.Method, Amount: p.Amount, Tip: p.Tip})
+	}
+	if coll, err := db.GetCollection("business"); err == nil {
+		var info struct {
+			CompanyName      string `bson:"companyName"`
+			CompanyAddress   string `bson:"companyAddress"`
+			VATID            string `bson:"vatId"`
+			CustomReceiptMsg string `bson:"customReceiptMsg"`
+			LegalFooter      string `bson:"legalFooter"`
+		}
+		if err := coll.FindOne(ctx, bson.M{}).Decode(&info); err == nil {
+			for _, h := range []string{info.CompanyName, info.CompanyAddress} {
+				if h != "" {
+					rc.Header = append(rc.Header, h)
+				}
+			}
+			if info.VATID != "" {
+				rc.Header = append(rc.Header, "VAT "+info.VATID)
+			}
+			for _, f := range []string{info.CustomReceiptMsg, info.LegalFooter} {
+				if f != "" {
+					rc.Footer = append(rc.Footer, f)
+				}
+			}
+		}
+	}
+	return rc
+}
+
+// printReceipt handles POST /api/sales/{id}/print, queueing the receipt on
+// the given printer or the location's receipt printer
+func printReceipt(ctx context.Context, w http.ResponseWriter, r *http.Request, s *Sale) {
+	var req struct {
+		PrinterID primitive.ObjectID `json:"printerId"`
+		Copy      bool               `json:"copy"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+	}
+	rc := receiptFor(ctx, s)
+	rc.Copy = req.Copy
+	job, err := printing.QueueReceipt(ctx, s.LocationID, req.PrinterID, rc, printing.Ref{SaleID: s.ID, TabID: s.TabID})
+	if errors.Is(err, printing.ErrNoPrinter) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"error":"no receipt printer at this location"}`))
+		return
+	} else if err != nil {
+		log.Printf("print error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,253 @@
+package sales
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page sizes for GET /api/sales. A request with neither limit nor cursor
+// gets every matching sale, as clients written before paging expect.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// sortFields maps the ?sort= names to stored fields
+var sortFields = map[string]string{
+	"createdAt": "createdAt",
+	"total":     "total",
+	"number":    "number",
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// saleQuery is a parsed GET /api/sales request
+type saleQuery struct {
+	filter bson.M
+	sort   string
+	desc   bool
+	limit  int
+	after  *pageCursor
+	// status is matched against the sales' refunds, not a stored field;
+	// see pipeline
+	status string
+}
+
+// pageCursor marks the last sale of a page: its sort value and ID. It is
+// handed to clients as an opaque string.
+type pageCursor struct {
+	Value interface{}        `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := bson.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c pageCursor
+	if err := bson.Unmarshal(data, &c); err != nil || c.ID.IsZero() {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// parseSaleQuery reads the filters, sort and page from the query string.
+// Errors name the offending parameter.
+func parseSaleQuery(r *http.Request) (*saleQuery, error) {
+	q := r.URL.Query()
+	sq := &saleQuery{filter: bson.M{}, sort: "createdAt", desc: true}
+
+	from, to, ok := periodParams(r)
+	if !ok {
+		return nil, errors.New("invalid from or to")
+	}
+	if from != nil || to != nil {
+		created := bson.M{}
+		if from != nil {
+			created["$gte"] = *from
+		}
+		if to != nil {
+			created["$lt"] = *to
+		}
+		sq.filter["createdAt"] = created
+	}
+	for param, field := range map[string]string{"locationId": "locationId", "tillId": "tillId", "customerId": "customerId", "shiftId": "shiftId"} {
+		if v := q.Get(param); v != "" {
+			id, err := primitive.ObjectIDFromHex(v)
+			if err != nil {
+				return nil, errors.New("invalid " + param)
+			}
+			sq.filter[field] = id
+		}
+	}
+	if v := q.Get("userId"); v != "" {
+		sq.filter["userId"] = v
+	}
+	if v := q.Get("paymentMethod"); v != "" {
+		sq.filter["payments.method"] = v
+	}
+	if v := q.Get("status"); v != "" {
+		if !validStatus(v) {
+			return nil, errors.New("invalid status")
+		}
+		sq.status = v
+	}
+	total := bson.M{}
+	for param, op := range map[string]string{"minTotal": "$gte", "maxTotal": "$lte"} {
+		if v := q.Get(param); v != "" {
+			n, err := money.Parse(v)
+			if err != nil {
+				return nil, errors.New("invalid " + param)
+			}
+			total[op] = n
+		}
+	}
+	if len(total) > 0 {
+		sq.filter["total"] = total
+	}
+
+	if v := q.Get("sort"); v != "" {
+		// A leading minus sorts descending, e.g. sort=-total
+		sq.desc = strings.HasPrefix(v, "-")
+		field, ok := sortFields[strings.TrimPrefix(v, "-")]
+		if !ok {
+			return nil, errors.New("invalid sort")
+		}
+		sq.sort = field
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("invalid limit")
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		sq.limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		sq.after = c
+		if sq.limit == 0 {
+			sq.limit = defaultPageSize
+		}
+	}
+	return sq, nil
+}
+
+// periodParams parses ?from= and ?to= as dates or RFC 3339 times. A bare to
+// date includes the whole of that day.
+func periodParams(r *http.Request) (from, to *time.Time, ok bool) {
+	parse := func(s string, end bool) (*time.Time, bool) {
+		if s == "" {
+			return nil, true
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return &t, true
+		}
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return nil, false
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, true
+	}
+	q := r.URL.Query()
+	from, okFrom := parse(q.Get("from"), false)
+	to, okTo := parse(q.Get("to"), true)
+	return from, to, okFrom && okTo
+}
+
+// findArgs returns the filter and options for one page. Sales are ordered by
+// the sort field and then by ID, so a cursor picks up exactly where the last
+// page stopped even when values tie.
+func (sq *saleQuery) findArgs() (bson.M, *options.FindOptions) {
+	filter, sort := sq.pageArgs()
+	opts := options.Find().SetSort(sort)
+	if sq.limit > 0 {
+		// One extra tells us whether there is another page
+		opts.SetLimit(int64(sq.limit + 1))
+	}
+	return filter, opts
+}
+
+// pipeline is findArgs for a status query. The status isn't stored, so each
+// sale's refunds are looked up as the sales are walked in order, and only
+// until the page is full.
+func (sq *saleQuery) pipeline() mongo.Pipeline {
+	filter, sort := sq.pageArgs()
+	p := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: sort}},
+		{{Key: "$lookup", Value: bson.M{"from": refundsCollection, "localField": "_id", "foreignField": "saleId", "as": "refunds"}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$eq": bson.A{statusExpr("$refunds"), sq.status}}}}},
+	}
+	if sq.limit > 0 {
+		p = append(p, bson.D{{Key: "$limit", Value: sq.limit + 1}})
+	}
+	return append(p, bson.D{{Key: "$project", Value: bson.M{"refunds": 0}}})
+}
+
+// pageArgs returns the filter, with the cursor applied, and the sort order
+func (sq *saleQuery) pageArgs() (bson.M, bson.D) {
+	dir, op := 1, "$gt"
+	if sq.desc {
+		dir, op = -1, "$lt"
+	}
+	filter := sq.filter
+	if sq.after != nil {
+		filter = bson.M{"$and": bson.A{sq.filter, bson.M{"$or": bson.A{
+			bson.M{sq.sort: bson.M{op: sq.after.Value}},
+			bson.M{sq.sort: sq.after.Value, "_id": bson.M{op: sq.after.ID}},
+		}}}}
+	}
+	return filter, bson.D{{Key: sq.sort, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// cursorAfter returns the cursor for the page following s
+func (sq *saleQuery) cursorAfter(s Sale) string {
+	var v interface{}
+	switch sq.sort {
+	case "total":
+		v = s.Total
+	case "number":
+		v = s.Number
+	default:
+		v = s.CreatedAt
+	}
+	return pageCursor{Value: v, ID: s.ID}.encode()
+}
+
+// writeSales writes a page of sales. The body stays a plain array for
+// existing clients; the next page's cursor goes in X-Next-Cursor.
+func writeSales(w http.ResponseWriter, sq *saleQuery, sales []Sale) error {
+	if sq.limit > 0 && len(sales) > sq.limit {
+		sales = sales[:sq.limit]
+		w.Header().Set("X-Next-Cursor", sq.cursorAfter(sales[len(sales)-1]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(sales)
+}
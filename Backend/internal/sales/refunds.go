@@ -0,0 +1,459 @@
+package sales
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/inventory"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/shifts"
+	"hospos-backend/internal/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Refund types. A void cancels a whole sale during the shift it was taken in;
+// a refund returns some or all of a sale afterwards. Either way the sale
+// itself is left as it was and the refund record is the reversing entry.
+const (
+	RefundTypeRefund = "refund"
+	RefundTypeVoid   = "void"
+)
+
+const refundsCollection = "refunds"
+
+type RefundLine struct {
+	// Line is the index of the line in the sale's products
+	Line      int                `json:"line" bson:"line"`
+	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
+	Name      string             `json:"name" bson:"name"`
+	Quantity  int                `json:"qty" bson:"qty"`
+	Amount    money.Money        `json:"amount" bson:"amount"`
+}
+
+type Refund struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SaleID     primitive.ObjectID `json:"saleId" bson:"saleId"`
+	SaleNumber string             `json:"saleNumber,omitempty" bson:"saleNumber,omitempty"`
+	Type       string             `json:"type" bson:"type"`
+	Lines      []RefundLine       `json:"lines" bson:"lines"`
+	// Amount and VAT are positive and are taken off the sale's figures
+	Amount money.Money `json:"amount" bson:"amount"`
+	VAT    money.Money `json:"vat" bson:"vat"`
+	// Currency is the sale's
+	Currency   string             `json:"currency,omitempty" bson:"currency,omitempty"`
+	Method     string             `json:"method" bson:"method"`
+	Reason     string             `json:"reason" bson:"reason"`
+	ApproverID string             `json:"approverId" bson:"approverId"`
+	ApprovedBy string             `json:"approvedBy" bson:"approvedBy"`
+	UserID     string             `json:"userId,omitempty" bson:"userId,omitempty"`
+	UserName   string             `json:"userName,omitempty" bson:"userName,omitempty"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	TillID     primitive.ObjectID `json:"tillId,omitempty" bson:"tillId,omitempty"`
+	ShiftID    primitive.ObjectID `json:"shiftId,omitempty" bson:"shiftId,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// refundRequest is the body of the refund and void endpoints. Lines are only
+// used by refunds; leaving them out refunds everything not yet refunded.
+type refundRequest struct {
+	Lines []struct {
+		Line     int `json:"line"`
+		Quantity int `json:"qty"`
+	} `json:"lines"`
+	Reason       string `json:"reason"`
+	Method       string `json:"method"`
+	ApproverName string `json:"approverName"`
+	ApproverPin  string `json:"approverPin"`
+}
+
+// lineTotal is what a sale line was charged before any sale discount. Sales
+// from before server pricing have no stored line total.
+func (p SaleProduct) lineTotal() money.Money {
+	if p.LineTotal != 0 {
+		return p.LineTotal
+	}
+	return p.Price.Times(p.Quantity)
+}
+
+// netTotal is the sale's lines after the discounts recorded against each
+func (s *Sale) netTotal() money.Money {
+	var total money.Money
+	for _, p := range s.Products {
+		total += p.lineTotal() - p.Discount
+	}
+	return total
+}
+
+// saleRefunds loads every refund and void recorded against a sale
+func saleRefunds(ctx context.Context, saleID primitive.ObjectID) ([]Refund, error) {
+	coll, err := db.GetCollection(refundsCollection)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := coll.Find(ctx, bson.M{"saleId": saleID}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := []Refund{}
+	err = cur.All(ctx, &list)
+	return list, err
+}
+
+// refundedQty totals refunded quantities per sale line, and reports whether
+// the sale has been voided
+func refundedQty(refunds []Refund) (map[int]int, bool) {
+	qty := map[int]int{}
+	voided := false
+	for _, rf := range refunds {
+		voided = voided || rf.Type == RefundTypeVoid
+		for _, l := range rf.Lines {
+			qty[l.Line] += l.Quantity
+		}
+	}
+	return qty, voided
+}
+
+// saleAction handles POST /api/sales/{id}/refund, POST /api/sales/{id}/void
+// and GET /api/sales/{id}/refunds
+func saleAction(w http.ResponseWriter, r *http.Request, idStr, action string) {
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	var s Sale
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s); err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	switch {
+	case action == "refunds" && r.Method == http.MethodGet:
+		refunds, err := saleRefunds(ctx, s.ID)
+		if err != nil {
+			log.Printf("refunds error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(refunds)
+	case (action == "refund" || action == "void") && r.Method == http.MethodPost:
+		reverseSale(ctx, w, r, &s, action)
+	case action == "print" && r.Method == http.MethodPost:
+		printReceipt(ctx, w, r, &s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// reverseSale records a refund or void against a sale and puts the stock back
+func reverseSale(ctx context.Context, w http.ResponseWriter, r *http.Request, s *Sale, kind string) {
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	if req.Reason == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"reason required"}`))
+		return
+	}
+	approver, err := users.ManagerApproval(ctx, r, req.ApproverName, req.ApproverPin)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"manager approval required"}`))
+		return
+	}
+	previous, err := saleRefunds(ctx, s.ID)
+	if err != nil {
+		log.Printf("refunds error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	done, voided := refundedQty(previous)
+	if voided {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"sale is void"}`))
+		return
+	}
+	rf := Refund{
+		ID:         primitive.NewObjectID(),
+		SaleID:     s.ID,
+		SaleNumber: s.Number,
+		Type:       kind,
+		Currency:   s.Currency,
+		Reason:     req.Reason,
+		Method:     req.Method,
+		ApproverID: approver.ID,
+		ApprovedBy: approver.Name,
+		LocationID: s.LocationID,
+		CreatedAt:  time.Now(),
+	}
+	if u, err := users.FromRequest(ctx, r); err == nil {
+		rf.UserID, rf.UserName = u.ID, u.Name
+	}
+	if till, err := primitive.ObjectIDFromHex(r.Header.Get("X-Till-ID")); err == nil {
+		rf.TillID = till
+		if shift, err := shifts.Current(ctx, till); err == nil && shift != nil {
+			rf.ShiftID = shift.ID
+		}
+	}
+	if rf.Method == "" && len(s.Payments) == 1 {
+		rf.Method = s.Payments[0].Method
+	}
+
+	if kind == RefundTypeVoid {
+		// Voids only undo mistakes made on the current shift
+		open, err := shifts.IsOpen(ctx, s.ShiftID)
+		if err != nil {
+			log.Printf("shift error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if !open {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"sale is not in an open shift; refund it instead"}`))
+			return
+		}
+		if len(previous) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"sale has refunds and cannot be voided"}`))
+			return
+		}
+		rf.ShiftID = s.ShiftID
+		rf.Method = "original"
+		for i, p := range s.Products {
+			rf.Lines = append(rf.Lines, RefundLine{Line: i, ProductID: p.ProductID, Name: p.Name, Quantity: p.Quantity, Amount: p.lineTotal() - p.Discount})
+		}
+		rf.Amount, rf.VAT = s.Total, s.VAT
+	} else {
+		if rf.Method == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"refund method required"}`))
+			return
+		}
+		want := map[int]int{}
+		if len(req.Lines) == 0 {
+			for i, p := range s.Products {
+				if left := p.Quantity - done[i]; left > 0 {
+					want[i] = left
+				}
+			}
+		}
+		for _, l := range req.Lines {
+			if l.Line < 0 || l.Line >= len(s.Products) || l.Quantity <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"each line needs a valid line index and a positive qty"}`))
+				return
+			}
+			want[l.Line] += l.Quantity
+		}
+		if len(want) == 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"sale is already fully refunded"}`))
+			return
+		}
+		// Lines refund their value after their own discounts; any other
+		// difference from the total, such as the service charge or a discount
+		// on an older sale, is shared across them in proportion
+		net := s.netTotal()
+		complete := true
+		for i, p := range s.Products {
+			qty := want[i]
+			if qty > p.Quantity-done[i] {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "refund exceeds quantity sold", "line": i})
+				return
+			}
+			if done[i]+qty < p.Quantity {
+				complete = false
+			}
+			if qty == 0 {
+				continue
+			}
+			line := p.lineTotal() - p.Discount
+			amount := line.Fraction(int64(qty), int64(p.Quantity), discountRounding())
+			if net > 0 {
+				amount = line.Fraction(int64(qty)*int64(s.Total), int64(p.Quantity)*int64(net), discountRounding())
+			}
+			rf.Lines = append(rf.Lines, RefundLine{Line: i, ProductID: p.ProductID, Name: p.Name, Quantity: qty, Amount: amount})
+			rf.Amount += amount
+		}
+		if s.Total != 0 {
+			rf.VAT = s.VAT.Fraction(int64(rf.Amount), int64(s.Total), vatRounding())
+		}
+		if complete {
+			// The last refund takes whatever is left so rounding never leaves
+			// pennies behind
+			var paidBack, vatBack money.Money
+			for _, prev := range previous {
+				paidBack += prev.Amount
+				vatBack += prev.VAT
+			}
+			rf.Amount, rf.VAT = s.Total-paidBack, s.VAT-vatBack
+		}
+	}
+
+	coll, err := db.GetCollection(refundsCollection)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if _, err := coll.InsertOne(ctx, rf); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"sale is void"}`))
+			return
+		}
+		log.Printf("insert error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	// Another till may have refunded the same lines at the same moment; if
+	// so this one loses and is withdrawn
+	if !stillValid(ctx, s, rf) {
+		coll.DeleteOne(ctx, bson.M{"_id": rf.ID})
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"sale was changed by another till; try again"}`))
+		return
+	}
+
+	lines := make([]inventory.SaleLine, 0, len(rf.Lines))
+	for _, l := range rf.Lines {
+		lines = append(lines, inventory.SaleLine{ProductID: l.ProductID, Quantity: l.Quantity})
+	}
+	if err := inventory.RestoreForSale(ctx, rf.ID.Hex(), rf.UserName, s.LocationID, lines); err != nil {
+		log.Printf("[STOCK] %s %s: stock not restored: %v", kind, rf.ID.Hex(), err)
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rf)
+}
+
+// stillValid re-reads a sale's refunds after inserting one and checks the
+// combined refunds don't exceed the sale
+func stillValid(ctx context.Context, s *Sale, rf Refund) bool {
+	all, err := saleRefunds(ctx, s.ID)
+	if err != nil {
+		log.Printf("refunds error: %v", err)
+		return true
+	}
+	done, _ := refundedQty(all)
+	for i, p := range s.Products {
+		if done[i] > p.Quantity {
+			return false
+		}
+	}
+	for _, other := range all {
+		if other.ID != rf.ID && (other.Type == RefundTypeVoid || rf.Type == RefundTypeVoid) {
+			return false
+		}
+	}
+	return true
+}
+
+// saleStatus works out a sale's status from the refunds recorded against it
+func saleStatus(s *Sale, refunds []Refund) string {
+	done, voided := refundedQty(refunds)
+	switch {
+	case voided:
+		return StatusVoid
+	case len(refunds) == 0:
+		return StatusCompleted
+	}
+	for i, p := range s.Products {
+		if done[i] < p.Quantity {
+			return StatusPartiallyRefunded
+		}
+	}
+	return StatusRefunded
+}
+
+// refundsBySale loads the refunds recorded against the given sales, grouped
+// by sale
+func refundsBySale(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID][]Refund, error) {
+	coll, err := db.GetCollection(refundsCollection)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := coll.Find(ctx, bson.M{"saleId": bson.M{"$in": ids}}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var list []Refund
+	if err := cur.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	bySale := map[primitive.ObjectID][]Refund{}
+	for _, rf := range list {
+		bySale[rf.SaleID] = append(bySale[rf.SaleID], rf)
+	}
+	return bySale, nil
+}
+
+// setStatuses fills in each sale's status from its refunds. The stored
+// sale is never changed after it is taken, so the status is worked out
+// whenever sales are read.
+func setStatuses(ctx context.Context, sales []Sale) error {
+	if len(sales) == 0 {
+		return nil
+	}
+	ids := make([]primitive.ObjectID, len(sales))
+	for i, s := range sales {
+		ids[i] = s.ID
+	}
+	bySale, err := refundsBySale(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range sales {
+		sales[i].Status = saleStatus(&sales[i], bySale[sales[i].ID])
+	}
+	return nil
+}
+
+// statusExpr is saleStatus as an aggregation expression over a sale and its
+// refunds. No line can be refunded beyond what was sold, so a sale is fully
+// refunded once the quantities refunded add up to the quantities sold.
+func statusExpr(refunds string) bson.M {
+	refunded := bson.M{"$sum": bson.M{"$map": bson.M{"input": refunds, "in": bson.M{"$sum": "$$this.lines.qty"}}}}
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$in": bson.A{RefundTypeVoid, refunds + ".type"}}, "then": StatusVoid},
+			bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$size": refunds}, 0}}, "then": StatusCompleted},
+			bson.M{"case": bson.M{"$gte": bson.A{refunded, bson.M{"$sum": "$products.qty"}}}, "then": StatusRefunded},
+		},
+		"default": StatusPartiallyRefunded,
+	}}
+}
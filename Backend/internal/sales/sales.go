@@ -3,43 +3,176 @@ package sales
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
+	"hospos-backend/internal/business"
 	"hospos-backend/internal/db"
+	"hospos-backend/internal/inventory"
+	"hospos-backend/internal/kds"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/payments"
+	"hospos-backend/internal/printing"
+	"hospos-backend/internal/receipts"
+	"hospos-backend/internal/shifts"
+	"hospos-backend/internal/users"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Sale statuses. A sale is completed when taken; refunds and voids move it
+// on. The status is worked out from the refunds when a sale is read.
+const (
+	StatusCompleted         = "completed"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusRefunded          = "refunded"
+	StatusVoid              = "void"
+)
+
+func validStatus(s string) bool {
+	switch s {
+	case StatusCompleted, StatusPartiallyRefunded, StatusRefunded, StatusVoid:
+		return true
+	}
+	return false
+}
+
 type SaleProduct struct {
 	ProductID primitive.ObjectID `json:"product_id" bson:"product_id"`
 	Name      string             `json:"name" bson:"name"`
 	Quantity  int                `json:"qty" bson:"qty"`
-	Price     float64            `json:"price" bson:"price"`
+	// Price is the unit price including modifiers, as charged
+	Price     money.Money `json:"price" bson:"price"`
+	Modifiers []string    `json:"modifiers,omitempty" bson:"modifiers,omitempty"`
+	LineTotal money.Money `json:"lineTotal" bson:"lineTotal"`
+	// Discount is what the sale's discounts took off this line
+	Discount money.Money `json:"discount,omitempty" bson:"discount,omitempty"`
+	// OrderedAt is set on lines ordered earlier on a tab; they are priced
+	// at the price list in force then
+	OrderedAt *time.Time `json:"orderedAt,omitempty" bson:"orderedAt,omitempty"`
+	// category is the product's, for line discounts; set when priced
+	category string
 }
 
 type SalePayment struct {
-	Amount float64 `json:"amount" bson:"amount"`
-	Method string  `json:"method" bson:"method"`
+	Amount money.Money `json:"amount" bson:"amount"`
+	Method string      `json:"method" bson:"method"`
+	// Tip is given on top of Amount, e.g. added on the card machine
+	Tip money.Money `json:"tip,omitempty" bson:"tip,omitempty"`
 }
 
 type Sale struct {
-	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Products []SaleProduct      `json:"products" bson:"products"`
-	Total    float64            `json:"total" bson:"total"`
-	VAT      float64            `json:"vat" bson:"vat"`
-	Discount float64            `json:"discount" bson:"discount"`
-	Paid     float64            `json:"paid" bson:"paid"`
-	Payments []SalePayment      `json:"payments" bson:"payments"`
+	ID primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	// Number is the human-readable sale number, e.g. HOS-000123
+	Number string `json:"number,omitempty" bson:"number,omitempty"`
+	// Status is stored as completed and never updated; reads fill it in
+	// from the refunds recorded against the sale
+	Status   string        `json:"status" bson:"status"`
+	Products []SaleProduct `json:"products" bson:"products"`
+	// Currency is the business currency the amounts are in
+	Currency string `json:"currency,omitempty" bson:"currency,omitempty"`
+	// PricingMode is whether the prices included VAT (inclusive) or had it
+	// added (exclusive), and VATRate the rate charged
+	PricingMode string      `json:"pricingMode,omitempty" bson:"pricingMode,omitempty"`
+	VATRate     float64     `json:"vatRate,omitempty" bson:"vatRate,omitempty"`
+	Subtotal    money.Money `json:"subtotal" bson:"subtotal"`
+	Discount    money.Money `json:"discount" bson:"discount"`
+	// Total is gross, what is paid before tips: Net plus VAT
+	Total money.Money `json:"total" bson:"total"`
+	Net   money.Money `json:"net" bson:"net"`
+	VAT   money.Money `json:"vat" bson:"vat"`
+	// ServiceCharge is included in Total; Tips are not
+	ServiceCharge money.Money   `json:"serviceCharge" bson:"serviceCharge"`
+	Tips          money.Money   `json:"tips" bson:"tips"`
+	Paid          money.Money   `json:"paid" bson:"paid"`
+	Payments      []SalePayment `json:"payments" bson:"payments"`
+	// Covers is the party size, which may bring in the service charge
+	Covers int `json:"covers,omitempty" bson:"covers,omitempty"`
+	// ApplyServiceCharge adds (true) or waives (false) the location's service
+	// charge; left out, it follows the party size
+	ApplyServiceCharge *bool `json:"applyServiceCharge,omitempty" bson:"-"`
+	// DiscountRefs are the discounts asked for; the server works out the
+	// amounts and records them in Discounts
+	DiscountRefs `bson:",inline"`
+	Discounts    []AppliedDiscount  `json:"discounts,omitempty" bson:"discounts,omitempty"`
+	PriceListID  primitive.ObjectID `json:"priceListId,omitempty" bson:"priceListId,omitempty"`
+	// PriceMismatch holds the figures the till sent when they differed from
+	// the server's
+	PriceMismatch *Figures `json:"priceMismatch,omitempty" bson:"priceMismatch,omitempty"`
+	// LocationID is the selling site; stock is taken from its inventory
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	// TillID is the linked till the sale was taken on (X-Till-ID)
+	TillID primitive.ObjectID `json:"tillId,omitempty" bson:"tillId,omitempty"`
+	// ShiftID is the till's open shift when the sale was taken
+	ShiftID    primitive.ObjectID `json:"shiftId,omitempty" bson:"shiftId,omitempty"`
+	CustomerID primitive.ObjectID `json:"customerId,omitempty" bson:"customerId,omitempty"`
+	// TabID is the tab the sale settled, if any
+	TabID primitive.ObjectID `json:"tabId,omitempty" bson:"tabId,omitempty"`
+	// UserID and UserName are the staff member signed in on the till
+	UserID    string    `json:"userId,omitempty" bson:"userId,omitempty"`
+	UserName  string    `json:"userName,omitempty" bson:"userName,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	// StockWarnings lists products sold into negative stock; not stored
+	StockWarnings []string `json:"stockWarnings,omitempty" bson:"-"`
+}
+
+// stockLines returns the sale lines in the form inventory needs
+func (s *Sale) stockLines() []inventory.SaleLine {
+	lines := make([]inventory.SaleLine, 0, len(s.Products))
+	for _, p := range s.Products {
+		lines = append(lines, inventory.SaleLine{ProductID: p.ProductID, Quantity: p.Quantity})
+	}
+	return lines
+}
+
+// sendToKitchen sends a sale's items to the kitchen stations and printers.
+// The sale is already taken, so a failure is only logged.
+func sendToKitchen(ctx context.Context, s *Sale) {
+	o := kds.Order{Source: kds.SourceSale, LocationID: s.LocationID, SaleID: s.ID, SaleNumber: s.Number, OrderedBy: s.UserName}
+	for _, p := range s.Products {
+		o.Lines = append(o.Lines, kds.OrderLine{ProductID: p.ProductID, Name: p.Name, Quantity: p.Quantity, Modifiers: p.Modifiers})
+	}
+	if _, err := kds.Send(ctx, o); err != nil {
+		log.Printf("[KDS] sale %s not sent to the kitchen: %v", s.ID.Hex(), err)
+	}
+	if _, err := printing.QueueKitchen(ctx, o); err != nil {
+		log.Printf("[PRINT] sale %s not printed for the kitchen: %v", s.ID.Hex(), err)
+	}
 }
 
 // No in-memory sales; use MongoDB
 
 func SalesHandler(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 4 && parts[2] == "by-number" {
+		saleByNumber(w, r, parts[3])
+		return
+	}
+	if len(parts) == 4 {
+		saleAction(w, r, parts[2], parts[3])
+		return
+	}
+	if len(parts) > 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
+		if len(parts) == 3 {
+			saleByID(w, r, parts[2])
+			return
+		}
+		sq, err := parseSaleQuery(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
 		coll, err := db.GetCollection("sales")
 		if err != nil {
 			log.Printf("db error: %v", err)
@@ -49,7 +182,13 @@ func SalesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
-		cur, err := coll.Find(ctx, bson.M{})
+		var cur *mongo.Cursor
+		if sq.status != "" {
+			cur, err = coll.Aggregate(ctx, sq.pipeline())
+		} else {
+			filter, opts := sq.findArgs()
+			cur, err = coll.Find(ctx, filter, opts)
+		}
 		if err != nil {
 			log.Printf("find error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -57,45 +196,68 @@ func SalesHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer cur.Close(ctx)
-		var sales []Sale
+		sales := []Sale{}
 		if err := cur.All(ctx, &sales); err != nil {
 			log.Printf("decode error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(`{"error":"db error"}`))
 			return
 		}
-		if err := json.NewEncoder(w).Encode(sales); err != nil {
-			log.Printf("encode error: %v", err)
+		if err := setStatuses(ctx, sales); err != nil {
+			log.Printf("refunds error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if err := writeSales(w, sq, sales); err != nil {
+			log.Printf("encode error: %v", err)
 		}
 	case http.MethodPost:
+		if len(parts) > 2 {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 		var s Sale
 		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(`{"error":"invalid input"}`))
 			return
 		}
-		// Calculate VAT (20% UK standard) if not provided
-		if s.VAT == 0 {
-			s.VAT = s.Total * 0.2
+		// Room for the checkout transaction to be retried
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if !CaptureContext(ctx, w, r, &s) {
+			return
 		}
-		coll, err := db.GetCollection("sales")
+		// The server's prices are the ones recorded, whatever the till sent
+		s.PriceMismatch = nil
+		s.TabID = primitive.NilObjectID
+		sent, err := priceSale(ctx, &s, s.CreatedAt)
 		if err != nil {
-			log.Printf("db error: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"error":"db error"}`))
+			WriteError(w, err)
 			return
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		defer cancel()
-		res, err := coll.InsertOne(ctx, s)
-		if err != nil {
-			log.Printf("insert error: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"error":"db error"}`))
+		server := Figures{Total: s.Total, VAT: s.VAT, Discount: s.Discount, ServiceCharge: s.ServiceCharge}
+		if mismatch(sent, server) {
+			if rejectMismatches() {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "price mismatch", "expected": server, "received": sent})
+				return
+			}
+			log.Printf("[PRICE] sale totals differ from till: sent %+v, server %+v", sent, server)
+			s.PriceMismatch = &sent
+		}
+		// Checked against the server's total, as when a tab is settled
+		if s.Paid < s.Total {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "payments do not cover the total", "total": s.Total, "paid": s.Paid})
 			return
 		}
-		s.ID = res.InsertedID.(primitive.ObjectID)
+		if err := Commit(ctx, &s); err != nil {
+			WriteError(w, err)
+			return
+		}
+		sendToKitchen(ctx, &s)
 		w.WriteHeader(http.StatusCreated)
 		if err := json.NewEncoder(w).Encode(s); err != nil {
 			log.Printf("encode error: %v", err)
@@ -104,3 +266,262 @@ func SalesHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// Price prices a sale on the server, replacing whatever figures it carried.
+func Price(ctx context.Context, s *Sale) error {
+	_, err := priceSale(ctx, s, s.CreatedAt)
+	return err
+}
+
+// Commit stores a priced sale: it takes the stock, allocates the sale number
+// and inserts the sale with its payment and receipt records. Where the
+// database supports transactions all of it is written in one, retried on
+// transient errors; otherwise each step is undone if a later one fails.
+func Commit(ctx context.Context, s *Sale) error {
+	s.ID = primitive.NewObjectID()
+	s.Status = StatusCompleted
+	if !db.SupportsTransactions(ctx) {
+		return commitSteps(ctx, s)
+	}
+	// Low-stock alerts wait for the commit; a rolled back sale sends none
+	var alerts *inventory.PendingAlerts
+	err := db.WithTransaction(ctx, func(tx context.Context) error {
+		tx, alerts = inventory.DeferAlerts(tx)
+		warnings, err := inventory.DepleteForSale(tx, s.ID.Hex(), s.UserName, s.LocationID, s.stockLines())
+		if err != nil {
+			return err
+		}
+		s.StockWarnings = warnings
+		number, _, err := business.NextSaleNumber(tx)
+		if err != nil {
+			return err
+		}
+		s.Number = number
+		coll, err := db.GetCollection("sales")
+		if err != nil {
+			return err
+		}
+		if _, err := coll.InsertOne(tx, s); err != nil {
+			return err
+		}
+		return insertRecords(tx, s)
+	})
+	if err != nil {
+		s.Number, s.StockWarnings = "", nil
+		return err
+	}
+	alerts.Send()
+	logStockWarnings(s)
+	return nil
+}
+
+// commitSteps stores a sale one step at a time, for servers without
+// transactions. The payment and receipt records come last; the sale stands
+// if they fail.
+func commitSteps(ctx context.Context, s *Sale) error {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return err
+	}
+	// Take the stock first so a blocked product rejects the whole sale
+	warnings, err := inventory.DepleteForSale(ctx, s.ID.Hex(), s.UserName, s.LocationID, s.stockLines())
+	if err != nil {
+		return err
+	}
+	s.StockWarnings = warnings
+	// Numbers are taken last so a rejected sale doesn't use one up
+	number, n, err := business.NextSaleNumber(ctx)
+	if err != nil {
+		if err := inventory.RestoreForSale(ctx, s.ID.Hex(), s.UserName, s.LocationID, s.stockLines()); err != nil {
+			log.Printf("stock restore error: %v", err)
+		}
+		return err
+	}
+	s.Number = number
+	if _, err := coll.InsertOne(ctx, s); err != nil {
+		if !business.ReleaseSaleNumber(ctx, n) {
+			log.Printf("[SALES] sale number %s was allocated but not used", number)
+		}
+		if err := inventory.RestoreForSale(ctx, s.ID.Hex(), s.UserName, s.LocationID, s.stockLines()); err != nil {
+			log.Printf("stock restore error: %v", err)
+		}
+		return err
+	}
+	if err := insertRecords(ctx, s); err != nil {
+		log.Printf("[SALES] sale %s stored without its payment or receipt records: %v", s.Number, err)
+	}
+	logStockWarnings(s)
+	return nil
+}
+
+// insertRecords stores a sale's payments and its receipt record
+func insertRecords(ctx context.Context, s *Sale) error {
+	if len(s.Payments) > 0 {
+		coll, err := db.GetCollection("payments")
+		if err != nil {
+			return err
+		}
+		docs := make([]interface{}, 0, len(s.Payments))
+		for _, p := range s.Payments {
+			docs = append(docs, payments.Payment{ID: primitive.NewObjectID(), SaleID: s.ID, Amount: p.Amount, Method: p.Method, Tip: p.Tip, Currency: s.Currency})
+		}
+		if _, err := coll.InsertMany(ctx, docs); err != nil {
+			return err
+		}
+	}
+	coll, err := db.GetCollection("receipts")
+	if err != nil {
+		return err
+	}
+	rc := receipts.Receipt{
+		ID:         primitive.NewObjectID(),
+		SaleID:     s.ID,
+		SaleNumber: s.Number,
+		Detail:     fmt.Sprintf("%d lines, total %s, paid %s", len(s.Products), s.Total, s.Paid),
+	}
+	_, err = coll.InsertOne(ctx, rc)
+	return err
+}
+
+func logStockWarnings(s *Sale) {
+	for _, warning := range s.StockWarnings {
+		log.Printf("[STOCK] sale %s: %s", s.ID.Hex(), warning)
+	}
+}
+
+// WriteError answers a request whose sale could not be priced or committed
+func WriteError(w http.ResponseWriter, err error) {
+	var pe *PricingError
+	var stockErr *inventory.StockError
+	var de *DiscountError
+	switch {
+	case errors.As(err, &pe):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": pe.Msg, "line": pe.Line})
+	case errors.As(err, &de):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": de.Msg, "discount": de.Ref})
+	case errors.Is(err, ErrInvalidDiscount):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"discount not found, inactive or expired"}`))
+	case errors.As(err, &stockErr):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "insufficient stock", "product": stockErr.Product})
+	default:
+		log.Printf("sale error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+	}
+}
+
+// saleByNumber handles GET /api/sales/by-number/{number}
+func saleByNumber(w http.ResponseWriter, r *http.Request, number string) {
+	findSale(w, r, bson.M{"number": number})
+}
+
+// saleByID handles GET /api/sales/{id}
+func saleByID(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	findSale(w, r, bson.M{"_id": id})
+}
+
+func findSale(w http.ResponseWriter, r *http.Request, filter bson.M) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var s Sale
+	if err := coll.FindOne(ctx, filter).Decode(&s); err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	refunds, err := saleRefunds(ctx, s.ID)
+	if err != nil {
+		log.Printf("refunds error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	s.Status = saleStatus(&s, refunds)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// CaptureContext fills in who, where and when a sale was taken from the
+// request rather than the body. A missing token is allowed for older tills,
+// but a bad one is refused, as is an unknown customer.
+func CaptureContext(ctx context.Context, w http.ResponseWriter, r *http.Request, s *Sale) bool {
+	s.CreatedAt = time.Now()
+	s.UserID, s.UserName = "", ""
+	// Tills can't backdate lines to an earlier price list
+	for i := range s.Products {
+		s.Products[i].OrderedAt = nil
+	}
+	if r.Header.Get("Authorization") != "" {
+		u, err := users.FromRequest(ctx, r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid token"}`))
+			return false
+		}
+		s.UserID, s.UserName = u.ID, u.Name
+	}
+	// A linked till's ID is its location's ID
+	s.TillID, s.ShiftID = primitive.NilObjectID, primitive.NilObjectID
+	if till, err := primitive.ObjectIDFromHex(r.Header.Get("X-Till-ID")); err == nil {
+		s.TillID = till
+		if s.LocationID.IsZero() {
+			s.LocationID = till
+		}
+		shift, err := shifts.Current(ctx, till)
+		if err != nil {
+			log.Printf("shift lookup error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return false
+		}
+		if shift != nil {
+			s.ShiftID = shift.ID
+		}
+	}
+	if !s.CustomerID.IsZero() {
+		coll, err := db.GetCollection("customers")
+		if err != nil {
+			log.Printf("db error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return false
+		}
+		if err := coll.FindOne(ctx, bson.M{"_id": s.CustomerID}).Err(); err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unknown customer"}`))
+			return false
+		} else if err != nil {
+			log.Printf("customer lookup error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package shifts
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	StatusOpen   = "open"
+	StatusClosed = "closed"
+)
+
+const collectionName = "shifts"
+
+// Shift is a trading session on one till, from opening to cashing up. Sales
+// taken while it is open belong to it.
+type Shift struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	TillID   primitive.ObjectID `json:"tillId" bson:"tillId"`
+	Status   string             `json:"status" bson:"status"`
+	OpenedBy string             `json:"openedBy" bson:"openedBy"`
+	OpenedAt time.Time          `json:"openedAt" bson:"openedAt"`
+	ClosedBy string             `json:"closedBy,omitempty" bson:"closedBy,omitempty"`
+	ClosedAt *time.Time         `json:"closedAt,omitempty" bson:"closedAt,omitempty"`
+}
+
+// Current returns the open shift on a till, or nil if there is none.
+func Current(ctx context.Context, till primitive.ObjectID) (*Shift, error) {
+	if till.IsZero() {
+		return nil, nil
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	var s Shift
+	err = coll.FindOne(ctx, bson.M{"tillId": till, "status": StatusOpen}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// IsOpen reports whether a shift is still open
+func IsOpen(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	if id.IsZero() {
+		return false, nil
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		return false, err
+	}
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": id, "status": StatusOpen})
+	return n > 0, err
+}
+
+// tillParam reads the till from the X-Till-ID header or ?tillId=
+func tillParam(r *http.Request) primitive.ObjectID {
+	if id, err := primitive.ObjectIDFromHex(r.Header.Get("X-Till-ID")); err == nil {
+		return id
+	}
+	id, _ := primitive.ObjectIDFromHex(r.URL.Query().Get("tillId"))
+	return id
+}
+
+func userName(ctx context.Context, r *http.Request) string {
+	if u, err := users.FromRequest(ctx, r); err == nil {
+		return u.Name
+	}
+	return ""
+}
+
+// ShiftsHandler handles /api/shifts and its sub-routes
+func ShiftsHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	switch {
+	case len(parts) == 3 && parts[2] == "current" && r.Method == http.MethodGet:
+		s, err := Current(ctx, tillParam(r))
+		if err != nil {
+			log.Printf("shift error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		if s == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"no open shift"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case len(parts) == 4 && parts[3] == "close" && r.Method == http.MethodPost:
+		id, err := primitive.ObjectIDFromHex(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid id"}`))
+			return
+		}
+		now := time.Now()
+		var s Shift
+		err = coll.FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "status": StatusOpen},
+			bson.M{"$set": bson.M{"status": StatusClosed, "closedBy": userName(ctx, r), "closedAt": now}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&s)
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"shift not found or already closed"}`))
+			return
+		}
+		if err != nil {
+			log.Printf("update error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		filter := bson.M{}
+		if till := tillParam(r); !till.IsZero() {
+			filter["tillId"] = till
+		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filter["status"] = status
+		}
+		cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "openedAt", Value: -1}}).SetLimit(200))
+		if err != nil {
+			log.Printf("find error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		defer cur.Close(ctx)
+		list := []Shift{}
+		if err := cur.All(ctx, &list); err != nil {
+			log.Printf("decode error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		till := tillParam(r)
+		if till.IsZero() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"till required"}`))
+			return
+		}
+		s := Shift{
+			ID:       primitive.NewObjectID(),
+			TillID:   till,
+			Status:   StatusOpen,
+			OpenedBy: userName(ctx, r),
+			OpenedAt: time.Now(),
+		}
+		// The unique index on open shifts stops a till having two
+		if _, err := coll.InsertOne(ctx, s); mongo.IsDuplicateKeyError(err) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"till already has an open shift"}`))
+			return
+		} else if err != nil {
+			log.Printf("insert error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,172 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CourseFire records a course being sent to the kitchen
+type CourseFire struct {
+	Course  int       `json:"course" bson:"course"`
+	FiredAt time.Time `json:"firedAt" bson:"firedAt"`
+	FiredBy string    `json:"firedBy,omitempty" bson:"firedBy,omitempty"`
+}
+
+// fireAttempts is how many times a fire is retried when the tab changes
+// under it; firing doesn't depend on what the till last saw
+const fireAttempts = 3
+
+// courseFired reports whether a course has been fired on the tab
+func (t *Tab) courseFired(course int) bool {
+	for _, f := range t.Fired {
+		if f.Course == course {
+			return true
+		}
+	}
+	return false
+}
+
+// holds decides whether a line added for a course is held. Lines outside a
+// course and for the first course go straight to the kitchen, as do lines
+// for a course already fired; later courses wait unless hold says otherwise.
+func (t *Tab) holds(course int, hold *bool) bool {
+	if hold != nil {
+		return *hold
+	}
+	return course > 1 && !t.courseFired(course)
+}
+
+// fired returns the lines that are not held
+func fired(lines []TabLine) []TabLine {
+	var out []TabLine
+	for _, l := range lines {
+		if !l.Held {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// fireCourse releases a tab's held lines for a course to the kitchen and
+// records when it was fired. Firing a course again sends anything held for
+// it since.
+func fireCourse(ctx context.Context, id primitive.ObjectID, course int, by string) (*Tab, error) {
+	for attempt := 1; ; attempt++ {
+		t, err := findTab(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		lines := make([]TabLine, len(t.Lines))
+		copy(lines, t.Lines)
+		var released []TabLine
+		for i := range lines {
+			if lines[i].Held && lines[i].Course == course {
+				lines[i].Held = false
+				lines[i].FiredAt = &now
+				released = append(released, lines[i])
+			}
+		}
+		if len(released) == 0 && t.courseFired(course) {
+			return t, nil
+		}
+		update := bson.M{"$set": bson.M{"lines": lines}}
+		if !t.courseFired(course) {
+			update["$push"] = bson.M{"fired": CourseFire{Course: course, FiredAt: now, FiredBy: by}}
+		}
+		t, err = change(ctx, id, t.Version, bson.M{"status": bson.M{"$in": activeStatuses}}, update)
+		if errors.Is(err, errChanged) && attempt < fireAttempts {
+			continue
+		}
+		if err != nil {
+			return t, err
+		}
+		sendToKitchen(ctx, t, released)
+		return t, nil
+	}
+}
+
+type fireRequest struct {
+	Course     int    `json:"course"`
+	Table      string `json:"table"`
+	LocationID string `json:"locationId"`
+}
+
+// fireHandler handles POST /api/tabs/{id}/fire
+func fireHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var req fireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Course < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"course required"}`))
+		return
+	}
+	t, err := fireCourse(ctx, id, req.Course, userName(ctx, r))
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// fireTableHandler handles POST /api/tabs/fire, firing a course on every
+// running tab at a table, such as the checks of a split bill
+func fireTableHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req fireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Course < 1 || req.Table == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"table and course required"}`))
+		return
+	}
+	filter := bson.M{"table": req.Table, "status": bson.M{"$in": activeStatuses}}
+	if req.LocationID != "" {
+		loc, err := primitive.ObjectIDFromHex(req.LocationID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid locationId"}`))
+			return
+		}
+		filter["locationId"] = loc
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	var found []Tab
+	if err := cur.All(ctx, &found); err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	if len(found) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"no open tab at that table"}`))
+		return
+	}
+	by := userName(ctx, r)
+	list := []Tab{}
+	for _, f := range found {
+		t, err := fireCourse(ctx, f.ID, req.Course, by)
+		if err != nil {
+			// Tabs already fired stay fired; the till can fire again for the rest
+			writeChangeError(w, t, err)
+			return
+		}
+		list = append(list, *t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
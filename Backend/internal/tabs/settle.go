@@ -0,0 +1,124 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"hospos-backend/internal/sales"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type settleRequest struct {
+	Version            int                 `json:"version"`
+	Payments           []sales.SalePayment `json:"payments"`
+	CustomerID         primitive.ObjectID  `json:"customerId"`
+	ApplyServiceCharge *bool               `json:"applyServiceCharge"`
+	sales.DiscountRefs
+}
+
+// settleTab handles POST /api/tabs/{id}/settle. The tab is held in settling
+// while it is turned into a sale, so a second till can't settle it too; if
+// the sale can't be made the tab goes back to how it was.
+func settleTab(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var req settleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"version required"}`))
+		return
+	}
+	t, err := findTab(ctx, id)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	s := sales.Sale{
+		LocationID:   t.LocationID,
+		CustomerID:   t.CustomerID,
+		DiscountRefs: req.DiscountRefs,
+		Payments:     req.Payments,
+		TabID:        t.ID,
+		Covers:       t.Covers,
+		// Left out, the service charge follows the party size
+		ApplyServiceCharge: req.ApplyServiceCharge,
+	}
+	if !req.CustomerID.IsZero() {
+		s.CustomerID = req.CustomerID
+	}
+	if !sales.CaptureContext(ctx, w, r, &s) {
+		return
+	}
+	switch {
+	case t.Status == StatusSplit:
+		// Settling a split tab closes it if every check is paid
+		parent, sale, err := closeParent(ctx, t.ID, s)
+		switch {
+		case errors.Is(err, errChecksOpen):
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"checks are still open"}`))
+		case err != nil:
+			writeChangeError(w, parent, err)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"tab": parent, "sale": sale})
+		}
+		return
+	case t.Share > 0:
+		settleShare(ctx, w, t, req, s)
+		return
+	}
+
+	previous := t.Status
+	t, err = change(ctx, id, req.Version,
+		bson.M{"status": bson.M{"$in": activeStatuses}},
+		bson.M{"$set": bson.M{"status": StatusSettling}})
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	release := func() {
+		if _, err := change(ctx, id, 0, bson.M{"status": StatusSettling}, bson.M{"$set": bson.M{"status": previous}}); err != nil {
+			log.Printf("[TABS] tab %s left settling: %v", id.Hex(), err)
+		}
+	}
+
+	// Lines keep the prices they were ordered at
+	s.Products = t.saleLines()
+	if err := sales.Price(ctx, &s); err != nil {
+		release()
+		sales.WriteError(w, err)
+		return
+	}
+	if s.Paid < s.Total {
+		release()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "payments do not cover the total", "total": s.Total, "paid": s.Paid})
+		return
+	}
+	if err := sales.Commit(ctx, &s); err != nil {
+		release()
+		sales.WriteError(w, err)
+		return
+	}
+
+	now := time.Now()
+	if _, err := change(ctx, id, 0, bson.M{"status": StatusSettling}, bson.M{
+		"$set":   bson.M{"status": StatusSettled, "saleId": s.ID, "saleNumber": s.Number, "settledAt": now},
+		"$unset": bson.M{"heldBy": ""},
+	}); err != nil {
+		// The sale stands; the tab only needs tidying
+		log.Printf("[TABS] tab %s settled as sale %s but not marked: %v", id.Hex(), s.ID.Hex(), err)
+	}
+	if !t.ParentID.IsZero() {
+		if _, _, err := closeParent(ctx, t.ParentID, s); err != nil && !errors.Is(err, errChecksOpen) {
+			log.Printf("[TABS] tab %s not closed: %v", t.ParentID.Hex(), err)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
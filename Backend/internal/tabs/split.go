@@ -0,0 +1,573 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/sales"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Ways of splitting a bill
+const (
+	SplitItems = "items"
+	SplitSeats = "seats"
+	SplitEqual = "equal"
+)
+
+const maxChecks = 50
+
+var errSplit = errors.New("invalid split")
+
+type splitRequest struct {
+	Version int    `json:"version"`
+	Mode    string `json:"mode"`
+	// Checks allocates the tab's lines for an items split: one list per
+	// check, each naming lines and how many of each
+	Checks [][]struct {
+		LineID   primitive.ObjectID `json:"lineId"`
+		Quantity int                `json:"qty"`
+	} `json:"checks"`
+	// Count is the number of shares in an equal split
+	Count int `json:"count"`
+	// The discounts the shares allow for
+	sales.DiscountRefs
+}
+
+// label names a tab for its checks
+func (t *Tab) label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return "Table " + t.Table
+}
+
+// equalShares divides total into n shares that differ by at most a penny and
+// add up exactly; the first checks take the spare pennies.
+func equalShares(total money.Money, n int) []money.Money {
+	return money.Allocate(total, make([]float64, n))
+}
+
+// newCheck starts a child check of t
+func newCheck(ctx context.Context, r *http.Request, t *Tab, name string, lines []TabLine) Tab {
+	now := time.Now()
+	c := Tab{
+		ID:    primitive.NewObjectID(),
+		Name:  name,
+		Table: t.Table,
+		// Each check is part of the same party, for the service charge
+		Covers:     t.Covers,
+		Status:     StatusOpen,
+		Lines:      lines,
+		CustomerID: t.CustomerID,
+		LocationID: t.LocationID,
+		HeldBy:     tillID(r),
+		OpenedBy:   userName(ctx, r),
+		OpenedAt:   now,
+		UpdatedAt:  now,
+		ParentID:   t.ID,
+		// Courses already fired stay fired on the checks
+		Fired:   t.Fired,
+		Version: 1,
+	}
+	for _, l := range lines {
+		c.Total += l.LineTotal
+	}
+	return c
+}
+
+// portion copies a line for qty of its items
+func portion(l TabLine, qty int) TabLine {
+	l.ID = primitive.NewObjectID()
+	l.Quantity = qty
+	l.LineTotal = l.Price.Times(qty)
+	return l
+}
+
+// planSplit works out the checks a tab splits into. An equal split also
+// returns the priced bill the shares are of.
+func planSplit(ctx context.Context, r *http.Request, t *Tab, req splitRequest) ([]Tab, *sales.Sale, error) {
+	if len(t.Lines) == 0 {
+		return nil, nil, fmt.Errorf("%w: tab has no items", errSplit)
+	}
+	var (
+		checks []Tab
+		bill   *sales.Sale
+	)
+	switch req.Mode {
+	case SplitItems:
+		if len(req.Checks) < 2 || len(req.Checks) > maxChecks {
+			return nil, nil, fmt.Errorf("%w: between 2 and %d checks needed", errSplit, maxChecks)
+		}
+		lines := map[primitive.ObjectID]TabLine{}
+		for _, l := range t.Lines {
+			lines[l.ID] = l
+		}
+		allocated := map[primitive.ObjectID]int{}
+		for i, alloc := range req.Checks {
+			var checkLines []TabLine
+			for _, a := range alloc {
+				l, ok := lines[a.LineID]
+				if !ok || a.Quantity < 1 {
+					return nil, nil, fmt.Errorf("%w: check %d needs known lines with a positive qty", errSplit, i+1)
+				}
+				allocated[a.LineID] += a.Quantity
+				checkLines = append(checkLines, portion(l, a.Quantity))
+			}
+			if len(checkLines) == 0 {
+				return nil, nil, fmt.Errorf("%w: check %d is empty", errSplit, i+1)
+			}
+			checks = append(checks, newCheck(ctx, r, t, fmt.Sprintf("%s %d/%d", t.label(), i+1, len(req.Checks)), checkLines))
+		}
+		for _, l := range t.Lines {
+			if allocated[l.ID] != l.Quantity {
+				return nil, nil, fmt.Errorf("%w: %s has %d allocated of %d", errSplit, l.Name, allocated[l.ID], l.Quantity)
+			}
+		}
+	case SplitSeats:
+		bySeat := map[int][]TabLine{}
+		for _, l := range t.Lines {
+			bySeat[l.Seat] = append(bySeat[l.Seat], portion(l, l.Quantity))
+		}
+		if len(bySeat) < 2 {
+			return nil, nil, fmt.Errorf("%w: all items are on one seat", errSplit)
+		}
+		seats := make([]int, 0, len(bySeat))
+		for seat := range bySeat {
+			seats = append(seats, seat)
+		}
+		sort.Ints(seats)
+		for _, seat := range seats {
+			// Items with no seat go on a check of their own
+			name := fmt.Sprintf("%s seat %d", t.label(), seat)
+			if seat == 0 {
+				name = t.label() + " shared"
+			}
+			checks = append(checks, newCheck(ctx, r, t, name, bySeat[seat]))
+		}
+	case SplitEqual:
+		if req.Count < 2 || req.Count > maxChecks {
+			return nil, nil, fmt.Errorf("%w: count must be between 2 and %d", errSplit, maxChecks)
+		}
+		// The shares are of what the whole bill comes to as one sale, priced
+		// now and kept so the shares paid always add up to it
+		s := sales.Sale{LocationID: t.LocationID, DiscountRefs: req.DiscountRefs, Covers: t.Covers, Products: t.saleLines(), CreatedAt: time.Now()}
+		if err := sales.Price(ctx, &s); err != nil {
+			return nil, nil, err
+		}
+		bill = &s
+		for i, share := range equalShares(s.Total, req.Count) {
+			c := newCheck(ctx, r, t, fmt.Sprintf("%s %d/%d", t.label(), i+1, req.Count), []TabLine{})
+			c.Share = share
+			checks = append(checks, c)
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w: mode must be items, seats or equal", errSplit)
+	}
+	return checks, bill, nil
+}
+
+// saleLines returns a tab's lines as sale lines at the prices they were
+// ordered at
+func (t *Tab) saleLines() []sales.SaleProduct {
+	products := make([]sales.SaleProduct, len(t.Lines))
+	for i, line := range t.Lines {
+		products[i] = line.SaleProduct
+		addedAt := line.AddedAt
+		products[i].OrderedAt = &addedAt
+	}
+	return products
+}
+
+// splitHandler handles POST /api/tabs/{id}/split
+func splitHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"version required"}`))
+		return
+	}
+	t, err := findTab(ctx, id)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	splitTab(ctx, w, r, t, req)
+}
+
+// splitTab splits t into checks and answers with the parent and its checks
+func splitTab(ctx context.Context, w http.ResponseWriter, r *http.Request, t *Tab, req splitRequest) {
+	if !t.ParentID.IsZero() || t.Share > 0 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"a check can't be split again"}`))
+		return
+	}
+	checks, bill, err := planSplit(ctx, r, t, req)
+	if errors.Is(err, errSplit) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		sales.WriteError(w, err)
+		return
+	}
+
+	previous := t.Status
+	set := bson.M{"status": StatusSplit, "splitMode": req.Mode}
+	if !req.DiscountID.IsZero() {
+		set["discountId"] = req.DiscountID
+	}
+	if len(req.DiscountIDs) > 0 {
+		set["discountIds"] = req.DiscountIDs
+	}
+	if len(req.DiscountCodes) > 0 {
+		set["discountCodes"] = req.DiscountCodes
+	}
+	if bill != nil {
+		set["bill"] = bill
+	}
+	parent, err := change(ctx, t.ID, req.Version,
+		bson.M{"status": bson.M{"$in": activeStatuses}},
+		bson.M{"$set": set, "$unset": bson.M{"heldBy": ""}})
+	if err != nil {
+		writeChangeError(w, parent, err)
+		return
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err == nil {
+		docs := make([]interface{}, len(checks))
+		for i := range checks {
+			docs[i] = checks[i]
+		}
+		_, err = coll.InsertMany(ctx, docs)
+	}
+	if err != nil {
+		log.Printf("split error: %v", err)
+		if coll != nil {
+			coll.DeleteMany(ctx, bson.M{"parentId": t.ID})
+		}
+		if _, err := change(ctx, t.ID, 0, bson.M{"status": StatusSplit},
+			bson.M{"$set": bson.M{"status": previous}, "$unset": bson.M{"splitMode": "", "discountId": "", "discountIds": "", "discountCodes": "", "bill": ""}}); err != nil {
+			log.Printf("[TABS] tab %s left split without checks: %v", t.ID.Hex(), err)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"parent": parent, "checks": checks})
+}
+
+// checksOf lists the checks split from a tab
+func checksOf(ctx context.Context, parentID primitive.ObjectID) ([]Tab, error) {
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := coll.Find(ctx, bson.M{"parentId": parentID})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	checks := []Tab{}
+	err = cur.All(ctx, &checks)
+	return checks, err
+}
+
+// listChecks handles GET /api/tabs/{id}/checks
+func listChecks(ctx context.Context, w http.ResponseWriter, id primitive.ObjectID) {
+	checks, err := checksOf(ctx, id)
+	if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checks)
+}
+
+// settleShare settles an equal-split check by recording its payments. The
+// sale is made when the last share is paid. Before any payment is taken the
+// shares are checked against the bill frozen at the split, so what the
+// guests pay always adds up to the sale that is made.
+func settleShare(ctx context.Context, w http.ResponseWriter, t *Tab, req settleRequest, base sales.Sale) {
+	var paid money.Money
+	for _, p := range req.Payments {
+		if p.Amount < 0 || p.Tip < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"payments and tips can't be negative"}`))
+			return
+		}
+		paid += p.Amount
+	}
+	if paid < t.Share {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "payments do not cover the share", "total": t.Share, "paid": paid})
+		return
+	}
+	if err := checkShares(ctx, t.ParentID); err != nil {
+		log.Printf("[TABS] tab %s: %v", t.ParentID.Hex(), err)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	t, err := change(ctx, t.ID, req.Version,
+		bson.M{"status": bson.M{"$in": activeStatuses}},
+		bson.M{"$set": bson.M{"status": StatusSettled, "payments": req.Payments, "settledAt": now}, "$unset": bson.M{"heldBy": ""}})
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	if _, _, err := closeParent(ctx, t.ParentID, base); err != nil && !errors.Is(err, errChecksOpen) {
+		log.Printf("[TABS] tab %s not closed: %v", t.ParentID.Hex(), err)
+	}
+	if latest, err := findTab(ctx, t.ID); err == nil {
+		t = latest
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// checkShares checks an equally split tab's shares add up to its frozen
+// bill. A tab split before bills were kept has its bill priced and frozen
+// here, before any more is paid.
+func checkShares(ctx context.Context, parentID primitive.ObjectID) error {
+	parent, err := findTab(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	if parent.Status != StatusSplit || parent.SplitMode != SplitEqual {
+		return errors.New("tab is not split equally")
+	}
+	if parent.Bill == nil {
+		s := sales.Sale{LocationID: parent.LocationID, DiscountRefs: parent.DiscountRefs, Covers: parent.Covers, Products: parent.saleLines(), CreatedAt: time.Now()}
+		if err := sales.Price(ctx, &s); err != nil {
+			return err
+		}
+		if parent, err = change(ctx, parentID, 0, bson.M{"status": StatusSplit, "bill": nil}, bson.M{"$set": bson.M{"bill": s}}); err != nil {
+			return err
+		}
+	}
+	checks, err := checksOf(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	var shares money.Money
+	for _, c := range checks {
+		shares += c.Share
+	}
+	if shares != parent.Bill.Total {
+		return fmt.Errorf("shares come to %s but the bill is %s", shares, parent.Bill.Total)
+	}
+	return nil
+}
+
+var errChecksOpen = errors.New("checks still open")
+
+// closeParent settles a split tab once all its checks are settled. A tab split
+// by items or seats just closes, its checks having made their own sales; an
+// equally split one becomes a single sale of the bill frozen at the split,
+// paid by all the shares, and is not priced again. base carries who and
+// where for that sale. A booking the tab was made from is closed with it.
+func closeParent(ctx context.Context, parentID primitive.ObjectID, base sales.Sale) (*Tab, *sales.Sale, error) {
+	checks, err := checksOf(ctx, parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range checks {
+		if c.Status != StatusSettled {
+			return nil, nil, errChecksOpen
+		}
+	}
+	// Only one request gets to close it
+	parent, err := change(ctx, parentID, 0, bson.M{"status": StatusSplit}, bson.M{"$set": bson.M{"status": StatusSettling}})
+	if err != nil {
+		return parent, nil, err
+	}
+	set := bson.M{"status": StatusSettled, "settledAt": time.Now()}
+	var sale *sales.Sale
+	if parent.SplitMode == SplitEqual {
+		s, err := shareSale(parent, checks, base)
+		if err == nil {
+			err = sales.Commit(ctx, &s)
+		}
+		if err != nil {
+			// Back to split so settling the tab again retries
+			change(ctx, parentID, 0, bson.M{"status": StatusSettling}, bson.M{"$set": bson.M{"status": StatusSplit}})
+			return parent, nil, err
+		}
+		sale = &s
+		set["saleId"], set["saleNumber"] = s.ID, s.Number
+		if coll, err := db.GetCollection(collectionName); err == nil {
+			coll.UpdateMany(ctx, bson.M{"parentId": parentID}, bson.M{"$set": bson.M{"saleId": s.ID, "saleNumber": s.Number}})
+		}
+	}
+	parent, err = change(ctx, parentID, 0, bson.M{"status": StatusSettling}, bson.M{"$set": set})
+	if err != nil {
+		log.Printf("[TABS] tab %s closed but not marked: %v", parentID.Hex(), err)
+	}
+	if parent != nil && !parent.BookingID.IsZero() {
+		closeBooking(ctx, parent.BookingID)
+	}
+	return parent, sale, nil
+}
+
+// shareSale makes the sale for an equally split tab: its frozen bill, paid by
+// the shares' payments and taken by whoever settled the last share
+func shareSale(parent *Tab, checks []Tab, base sales.Sale) (sales.Sale, error) {
+	if parent.Bill == nil {
+		return sales.Sale{}, errors.New("split tab has no bill")
+	}
+	s := *parent.Bill
+	s.UserID, s.UserName = base.UserID, base.UserName
+	s.TillID, s.ShiftID = base.TillID, base.ShiftID
+	s.CreatedAt = base.CreatedAt
+	s.CustomerID = parent.CustomerID
+	s.TabID = parent.ID
+	s.Payments = nil
+	s.Paid, s.Tips = 0, 0
+	for _, c := range checks {
+		for _, p := range c.Payments {
+			s.Payments = append(s.Payments, p)
+			s.Paid += p.Amount
+			s.Tips += p.Tip
+		}
+	}
+	if s.Paid < s.Total {
+		return s, fmt.Errorf("shares paid %s of %s", s.Paid, s.Total)
+	}
+	return s, nil
+}
+
+func closeBooking(ctx context.Context, id primitive.ObjectID) {
+	coll, err := db.GetCollection("bookings")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		return
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": id, "status": "open"},
+		bson.M{"$set": bson.M{"status": "closed", "closedAt": time.Now()}}); err != nil {
+		log.Printf("[TABS] booking %s not closed: %v", id.Hex(), err)
+	}
+}
+
+// SplitBooking handles POST /api/bookings/{id}/split. The booking's bill is
+// put on a tab, which is then split as POST /api/tabs/{id}/split would; the
+// booking closes when every check is settled.
+func SplitBooking(w http.ResponseWriter, r *http.Request, bookingID primitive.ObjectID) {
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	bookings, err := db.GetCollection("bookings")
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	var b struct {
+		CustomerID  primitive.ObjectID `bson:"customerId"`
+		TableNumber string             `bson:"tableNumber"`
+		Status      string             `bson:"status"`
+		Products    []struct {
+			ProductID primitive.ObjectID `bson:"productId"`
+			Qty       int                `bson:"qty"`
+		} `bson:"products"`
+	}
+	if err := bookings.FindOne(ctx, bson.M{"_id": bookingID}).Decode(&b); err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+		return
+	} else if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if b.Status != "open" {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"booking is not open"}`))
+		return
+	}
+
+	now := time.Now()
+	t := Tab{
+		ID:         primitive.NewObjectID(),
+		Name:       "Table " + b.TableNumber,
+		Table:      b.TableNumber,
+		Status:     StatusOpen,
+		CustomerID: b.CustomerID,
+		LocationID: tillID(r),
+		OpenedBy:   userName(ctx, r),
+		OpenedAt:   now,
+		UpdatedAt:  now,
+		BookingID:  bookingID,
+		Version:    1,
+	}
+	products := make([]sales.SaleProduct, len(b.Products))
+	for i, p := range b.Products {
+		products[i] = sales.SaleProduct{ProductID: p.ProductID, Quantity: p.Qty}
+	}
+	if _, err := sales.PriceLines(ctx, t.LocationID, now, products); err != nil {
+		sales.WriteError(w, err)
+		return
+	}
+	for _, p := range products {
+		t.Lines = append(t.Lines, TabLine{ID: primitive.NewObjectID(), SaleProduct: p, AddedAt: now})
+		t.Total += p.LineTotal
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	// The unique index on bookingId means a booking's bill is split only once
+	if _, err := coll.InsertOne(ctx, t); mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"booking bill is already on a tab"}`))
+		return
+	} else if err != nil {
+		log.Printf("insert error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	req.Version = t.Version
+	rec := &statusRecorder{ResponseWriter: w}
+	splitTab(ctx, rec, r, &t, req)
+	if rec.status != http.StatusCreated {
+		// Leave no half-made tab behind so the split can be tried again
+		coll.DeleteOne(ctx, bson.M{"_id": t.ID, "status": bson.M{"$ne": StatusSplit}})
+	}
+}
+
+// statusRecorder notes the status written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
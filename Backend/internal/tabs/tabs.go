@@ -0,0 +1,559 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/kds"
+	"hospos-backend/internal/money"
+	"hospos-backend/internal/printing"
+	"hospos-backend/internal/sales"
+	"hospos-backend/internal/users"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tab statuses. An open tab is on a till's screen; a parked one is put aside
+// until recalled. Settling is held briefly while the tab becomes a sale.
+const (
+	StatusOpen      = "open"
+	StatusParked    = "parked"
+	StatusSettling  = "settling"
+	StatusSettled   = "settled"
+	StatusCancelled = "cancelled"
+	// StatusSplit is a tab whose bill has been split into child checks; it
+	// is settled once they all are
+	StatusSplit = "split"
+)
+
+const collectionName = "tabs"
+
+var (
+	errNotFound = errors.New("tab not found")
+	// errChanged means the tab's version moved on since the till read it
+	errChanged = errors.New("tab was changed on another till")
+	errState   = errors.New("tab is not in a state that allows this")
+)
+
+// activeStatuses are the statuses in which items may be added
+var activeStatuses = bson.A{StatusOpen, StatusParked}
+
+// TabLine is an item ordered on a tab. It is priced when added, at the price
+// list in force then, and keeps that price when the tab is settled.
+type TabLine struct {
+	ID                primitive.ObjectID `json:"id" bson:"id"`
+	sales.SaleProduct `bson:",inline"`
+	Seat              int                `json:"seat,omitempty" bson:"seat,omitempty"`
+	Note              string             `json:"note,omitempty" bson:"note,omitempty"`
+	AddedBy           string             `json:"addedBy,omitempty" bson:"addedBy,omitempty"`
+	TillID            primitive.ObjectID `json:"tillId,omitempty" bson:"tillId,omitempty"`
+	AddedAt           time.Time          `json:"addedAt" bson:"addedAt"`
+	// Course is the line's course, from 1; 0 is not coursed
+	Course int `json:"course,omitempty" bson:"course,omitempty"`
+	// Held lines wait to be fired before going to the kitchen
+	Held    bool       `json:"held,omitempty" bson:"held,omitempty"`
+	FiredAt *time.Time `json:"firedAt,omitempty" bson:"firedAt,omitempty"`
+}
+
+// Tab is an order kept open while items are added, then settled as one sale.
+// Version goes up with every change; changes that depend on what the till
+// last saw must send it, and are refused if the tab has moved on.
+type Tab struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name   string             `json:"name,omitempty" bson:"name,omitempty"`
+	Table  string             `json:"table,omitempty" bson:"table,omitempty"`
+	Covers int                `json:"covers,omitempty" bson:"covers,omitempty"`
+	Status string             `json:"status" bson:"status"`
+	Lines  []TabLine          `json:"lines" bson:"lines"`
+	// Total is the running total of the lines, before any discount or service
+	// charge, and before VAT where prices exclude it
+	Total      money.Money        `json:"total" bson:"total"`
+	CustomerID primitive.ObjectID `json:"customerId,omitempty" bson:"customerId,omitempty"`
+	LocationID primitive.ObjectID `json:"locationId,omitempty" bson:"locationId,omitempty"`
+	// HeldBy is the till an open tab is on
+	HeldBy     primitive.ObjectID `json:"heldBy,omitempty" bson:"heldBy,omitempty"`
+	OpenedBy   string             `json:"openedBy,omitempty" bson:"openedBy,omitempty"`
+	OpenedAt   time.Time          `json:"openedAt" bson:"openedAt"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+	SaleID     primitive.ObjectID `json:"saleId,omitempty" bson:"saleId,omitempty"`
+	SaleNumber string             `json:"saleNumber,omitempty" bson:"saleNumber,omitempty"`
+	SettledAt  *time.Time         `json:"settledAt,omitempty" bson:"settledAt,omitempty"`
+	// BookingID is the booking whose bill the tab was made from
+	BookingID primitive.ObjectID `json:"bookingId,omitempty" bson:"bookingId,omitempty"`
+	// SplitMode is set on a split tab: items, seats or equal
+	SplitMode string `json:"splitMode,omitempty" bson:"splitMode,omitempty"`
+	// DiscountRefs are the discounts an equally split bill's shares allow for
+	sales.DiscountRefs `bson:",inline"`
+	// Bill is an equally split tab's sale, priced when it was split. The
+	// shares divide its total, and it is committed as it stands once they
+	// are all paid.
+	Bill *sales.Sale `json:"bill,omitempty" bson:"bill,omitempty"`
+	// ParentID is set on a check split from another tab
+	ParentID primitive.ObjectID `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	// Share is an equal-split check's part of its parent's total. It has no
+	// lines; its Payments count towards the parent's sale.
+	Share    money.Money         `json:"share,omitempty" bson:"share,omitempty"`
+	Payments []sales.SalePayment `json:"payments,omitempty" bson:"payments,omitempty"`
+	// Fired records when each course was fired, for pacing
+	Fired   []CourseFire `json:"fired,omitempty" bson:"fired,omitempty"`
+	Version int          `json:"version" bson:"version"`
+}
+
+func tillID(r *http.Request) primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(r.Header.Get("X-Till-ID"))
+	return id
+}
+
+func userName(ctx context.Context, r *http.Request) string {
+	if u, err := users.FromRequest(ctx, r); err == nil {
+		return u.Name
+	}
+	return ""
+}
+
+func findTab(ctx context.Context, id primitive.ObjectID) (*Tab, error) {
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	var t Tab
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&t); err == mongo.ErrNoDocuments {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// change applies update to a tab if it is still at version (0 skips the
+// check) and matches the extra conditions in filter, bumping the version. It
+// returns the updated tab, or the current one with errChanged or errState.
+func change(ctx context.Context, id primitive.ObjectID, version int, filter, update bson.M) (*Tab, error) {
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+	filter["_id"] = id
+	if version > 0 {
+		filter["version"] = version
+	}
+	inc, _ := update["$inc"].(bson.M)
+	if inc == nil {
+		inc = bson.M{}
+	}
+	inc["version"] = 1
+	update["$inc"] = inc
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+	}
+	set["updatedAt"] = time.Now()
+	update["$set"] = set
+
+	var t Tab
+	err = coll.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&t)
+	if err == nil {
+		return &t, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	current, err := findTab(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if version > 0 && current.Version != version {
+		return current, errChanged
+	}
+	return current, errState
+}
+
+// writeChangeError answers a request whose change to a tab was refused
+func writeChangeError(w http.ResponseWriter, t *Tab, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+	case errors.Is(err, errChanged), errors.Is(err, errState):
+		// The current tab lets the till refresh and try again
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "tab": t})
+	default:
+		log.Printf("tab error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+	}
+}
+
+// versionRequest is the body of changes that must name the version they
+// were made against
+type versionRequest struct {
+	Version int `json:"version"`
+}
+
+// TabsHandler handles /api/tabs and its sub-routes
+func TabsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			listTabs(ctx, w, r)
+		case http.MethodPost:
+			openTab(ctx, w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if len(parts) == 3 && parts[2] == "fire" {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		fireTableHandler(ctx, w, r)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(parts[2])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid id"}`))
+		return
+	}
+	action := ""
+	if len(parts) > 3 {
+		action = parts[3]
+	}
+	switch {
+	case action == "" && len(parts) == 3 && r.Method == http.MethodGet:
+		t, err := findTab(ctx, id)
+		if err != nil {
+			writeChangeError(w, nil, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	case action == "items" && len(parts) == 4 && r.Method == http.MethodPost:
+		addItems(ctx, w, r, id)
+	case action == "items" && len(parts) == 5 && r.Method == http.MethodDelete:
+		removeItem(ctx, w, r, id, parts[4])
+	case action == "park" && r.Method == http.MethodPost:
+		moveTab(ctx, w, r, id, StatusOpen, bson.M{"$set": bson.M{"status": StatusParked}, "$unset": bson.M{"heldBy": ""}})
+	case action == "recall" && r.Method == http.MethodPost:
+		update := bson.M{"$set": bson.M{"status": StatusOpen}}
+		if till := tillID(r); !till.IsZero() {
+			update["$set"].(bson.M)["heldBy"] = till
+		}
+		moveTab(ctx, w, r, id, StatusParked, update)
+	case action == "cancel" && r.Method == http.MethodPost:
+		cancelTab(ctx, w, r, id)
+	case action == "settle" && r.Method == http.MethodPost:
+		settleTab(ctx, w, r, id)
+	case action == "split" && r.Method == http.MethodPost:
+		splitHandler(ctx, w, r, id)
+	case action == "fire" && r.Method == http.MethodPost:
+		fireHandler(ctx, w, r, id)
+	case action == "checks" && r.Method == http.MethodGet:
+		listChecks(ctx, w, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// listTabs handles GET /api/tabs?status=&locationId=&table=&parentId=.
+// Without a status it lists the tabs still running.
+func listTabs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{"status": bson.M{"$in": bson.A{StatusOpen, StatusParked, StatusSettling, StatusSplit}}}
+	if status := q.Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if loc, err := primitive.ObjectIDFromHex(q.Get("locationId")); err == nil {
+		filter["locationId"] = loc
+	}
+	if table := q.Get("table"); table != "" {
+		filter["table"] = table
+	}
+	if parent, err := primitive.ObjectIDFromHex(q.Get("parentId")); err == nil {
+		filter["parentId"] = parent
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "openedAt", Value: -1}}).SetLimit(500))
+	if err != nil {
+		log.Printf("find error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	defer cur.Close(ctx)
+	list := []Tab{}
+	if err := cur.All(ctx, &list); err != nil {
+		log.Printf("decode error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// openTab handles POST /api/tabs. The tab starts open on the requesting till.
+func openTab(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name       string             `json:"name"`
+		Table      string             `json:"table"`
+		Covers     int                `json:"covers"`
+		CustomerID primitive.ObjectID `json:"customerId"`
+		LocationID primitive.ObjectID `json:"locationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid input"}`))
+		return
+	}
+	if req.Name == "" && req.Table == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"name or table required"}`))
+		return
+	}
+	now := time.Now()
+	t := Tab{
+		ID:         primitive.NewObjectID(),
+		Name:       req.Name,
+		Table:      req.Table,
+		Covers:     req.Covers,
+		Status:     StatusOpen,
+		Lines:      []TabLine{},
+		CustomerID: req.CustomerID,
+		LocationID: req.LocationID,
+		HeldBy:     tillID(r),
+		OpenedBy:   userName(ctx, r),
+		OpenedAt:   now,
+		UpdatedAt:  now,
+		Version:    1,
+	}
+	// A linked till's ID is its location's ID
+	if t.LocationID.IsZero() {
+		t.LocationID = t.HeldBy
+	}
+	coll, err := db.GetCollection(collectionName)
+	if err != nil {
+		log.Printf("db error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	if _, err := coll.InsertOne(ctx, t); err != nil {
+		log.Printf("insert error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"db error"}`))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// addItems handles POST /api/tabs/{id}/items. Any till may add to an open or
+// parked tab; items are appended, so adds from two tills don't clash and the
+// version is only checked if one is sent.
+func addItems(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var req struct {
+		Version int `json:"version"`
+		Items   []struct {
+			ProductID primitive.ObjectID `json:"product_id"`
+			Quantity  int                `json:"qty"`
+			Modifiers []string           `json:"modifiers"`
+			Seat      int                `json:"seat"`
+			Note      string             `json:"note"`
+			Course    int                `json:"course"`
+			// Hold holds (true) or fires (false) the line; left out, lines
+			// for a course after the first are held until it is fired
+			Hold *bool `json:"hold"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Items) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"items required"}`))
+		return
+	}
+	t, err := findTab(ctx, id)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	now := time.Now()
+	products := make([]sales.SaleProduct, len(req.Items))
+	for i, item := range req.Items {
+		if item.Seat < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid seat", "line": i})
+			return
+		}
+		if item.Course < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid course", "line": i})
+			return
+		}
+		products[i] = sales.SaleProduct{ProductID: item.ProductID, Quantity: item.Quantity, Modifiers: item.Modifiers}
+	}
+	if _, err := sales.PriceLines(ctx, t.LocationID, now, products); err != nil {
+		sales.WriteError(w, err)
+		return
+	}
+	lines := make([]TabLine, len(products))
+	var added money.Money
+	by, till := userName(ctx, r), tillID(r)
+	for i, p := range products {
+		lines[i] = TabLine{
+			ID:          primitive.NewObjectID(),
+			SaleProduct: p,
+			Seat:        req.Items[i].Seat,
+			Note:        req.Items[i].Note,
+			AddedBy:     by,
+			TillID:      till,
+			AddedAt:     now,
+			Course:      req.Items[i].Course,
+		}
+		lines[i].Held = t.holds(req.Items[i].Course, req.Items[i].Hold)
+		if !lines[i].Held {
+			lines[i].FiredAt = &now
+		}
+		added += p.LineTotal
+	}
+	// Equal-split shares carry an amount, not items
+	t, err = change(ctx, id, req.Version,
+		bson.M{"status": bson.M{"$in": activeStatuses}, "share": bson.M{"$exists": false}},
+		bson.M{"$push": bson.M{"lines": bson.M{"$each": lines}}, "$inc": bson.M{"total": added}})
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	sendToKitchen(ctx, t, fired(lines))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// sendToKitchen sends lines just added or fired on a tab to the kitchen
+// stations and printers. The lines are on the tab either way, so a failure
+// is only logged.
+func sendToKitchen(ctx context.Context, t *Tab, lines []TabLine) {
+	if len(lines) == 0 {
+		return
+	}
+	o := kds.Order{Source: kds.SourceTab, LocationID: t.LocationID, TabID: t.ID, Table: t.Table, Name: t.Name, OrderedBy: lines[0].AddedBy}
+	for _, l := range lines {
+		o.Lines = append(o.Lines, kds.OrderLine{
+			LineID:    l.ID,
+			ProductID: l.ProductID,
+			Name:      l.Name,
+			Quantity:  l.Quantity,
+			Modifiers: l.Modifiers,
+			Note:      l.Note,
+			Seat:      l.Seat,
+			Course:    l.Course,
+		})
+	}
+	if _, err := kds.Send(ctx, o); err != nil {
+		log.Printf("[KDS] tab %s items not sent to the kitchen: %v", t.ID.Hex(), err)
+	}
+	if _, err := printing.QueueKitchen(ctx, o); err != nil {
+		log.Printf("[PRINT] tab %s items not printed for the kitchen: %v", t.ID.Hex(), err)
+	}
+}
+
+// removeItem handles DELETE /api/tabs/{id}/items/{lineId}?version=N
+func removeItem(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID, lineStr string) {
+	lineID, err := primitive.ObjectIDFromHex(lineStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid line id"}`))
+		return
+	}
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil || version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"version required"}`))
+		return
+	}
+	t, err := findTab(ctx, id)
+	if err != nil {
+		writeChangeError(w, nil, err)
+		return
+	}
+	var line *TabLine
+	for i := range t.Lines {
+		if t.Lines[i].ID == lineID {
+			line = &t.Lines[i]
+		}
+	}
+	if line == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"line not found"}`))
+		return
+	}
+	t, err = change(ctx, id, version,
+		bson.M{"status": bson.M{"$in": activeStatuses}, "lines.id": lineID},
+		bson.M{"$pull": bson.M{"lines": bson.M{"id": lineID}}, "$inc": bson.M{"total": -line.LineTotal}})
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// moveTab handles park and recall, which move a tab on from one status
+func moveTab(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID, from string, update bson.M) {
+	var req versionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"version required"}`))
+		return
+	}
+	t, err := change(ctx, id, req.Version, bson.M{"status": from}, update)
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// cancelTab handles POST /api/tabs/{id}/cancel. Only a tab with nothing on it
+// can be cancelled; items must be removed first.
+func cancelTab(ctx context.Context, w http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var req versionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"version required"}`))
+		return
+	}
+	t, err := change(ctx, id, req.Version,
+		bson.M{"status": bson.M{"$in": activeStatuses}, "lines": bson.M{"$size": 0}},
+		bson.M{"$set": bson.M{"status": StatusCancelled}, "$unset": bson.M{"heldBy": ""}})
+	if err != nil {
+		writeChangeError(w, t, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
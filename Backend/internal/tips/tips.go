@@ -0,0 +1,298 @@
+// Package tips reports the tips and service charge taken on sales and shares
+// them out among staff.
+package tips
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"hospos-backend/internal/business"
+	"hospos-backend/internal/db"
+	"hospos-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ways of sharing out a tip pool
+const (
+	BasisHours = "hours"
+	BasisSales = "sales"
+)
+
+// StaffTips is one staff member's part of the takings
+type StaffTips struct {
+	UserID        string      `json:"userId"`
+	UserName      string      `json:"userName"`
+	Sales         money.Money `json:"sales"`
+	ServiceCharge money.Money `json:"serviceCharge"`
+	Tips          money.Money `json:"tips"`
+}
+
+// Summary is the tips and service charge taken in a period
+type Summary struct {
+	// Currency is the code the amounts are in
+	Currency      string                 `json:"currency"`
+	Tips          money.Money            `json:"tips"`
+	ServiceCharge money.Money            `json:"serviceCharge"`
+	ByMethod      map[string]money.Money `json:"byMethod"`
+	ByStaff       []StaffTips            `json:"byStaff"`
+}
+
+// Share is one staff member's part of a tip pool
+type Share struct {
+	UserID   string      `json:"userId"`
+	UserName string      `json:"userName"`
+	Weight   float64     `json:"weight"`
+	Amount   money.Money `json:"amount"`
+}
+
+// Pool is a tip pool shared out by hours worked or by sales taken
+type Pool struct {
+	From   *time.Time  `json:"from,omitempty"`
+	To     *time.Time  `json:"to,omitempty"`
+	Basis  string      `json:"basis"`
+	Total  money.Money `json:"total"`
+	Shares []Share     `json:"shares"`
+}
+
+var errPeriod = errors.New("invalid from or to")
+
+// parsePeriod parses from and to as dates or RFC 3339 times. A bare to date
+// includes the whole of that day.
+func parsePeriod(fromStr, toStr string) (from, to *time.Time, err error) {
+	parse := func(s string, end bool) (*time.Time, error) {
+		if s == "" {
+			return nil, nil
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return &t, nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return nil, errPeriod
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t, nil
+	}
+	if from, err = parse(fromStr, false); err != nil {
+		return nil, nil, err
+	}
+	if to, err = parse(toStr, true); err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+// Summarise totals the tips and service charge on sales in a period,
+// optionally for one location. Void sales are left out.
+func Summarise(ctx context.Context, location primitive.ObjectID, from, to *time.Time) (*Summary, error) {
+	coll, err := db.GetCollection("sales")
+	if err != nil {
+		return nil, err
+	}
+	// A sale's status isn't stored; voids are in the refunds collection
+	refunds, err := db.GetCollection("refunds")
+	if err != nil {
+		return nil, err
+	}
+	// A void is recorded after its sale, so only voids since the period
+	// began can be of its sales
+	voids := bson.M{"type": "void"}
+	if !location.IsZero() {
+		voids["locationId"] = location
+	}
+	if from != nil {
+		voids["createdAt"] = bson.M{"$gte": *from}
+	}
+	voided, err := refunds.Distinct(ctx, "saleId", voids)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": bson.M{"$nin": voided}}
+	if !location.IsZero() {
+		filter["locationId"] = location
+	}
+	if from != nil || to != nil {
+		created := bson.M{}
+		if from != nil {
+			created["$gte"] = *from
+		}
+		if to != nil {
+			created["$lt"] = *to
+		}
+		filter["createdAt"] = created
+	}
+	opts := options.Find().SetProjection(bson.M{"userId": 1, "userName": 1, "total": 1, "serviceCharge": 1, "tips": 1, "payments": 1})
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	summary := &Summary{Currency: business.Currency(ctx), ByMethod: map[string]money.Money{}, ByStaff: []StaffTips{}}
+	staff := map[string]*StaffTips{}
+	for cur.Next(ctx) {
+		var s struct {
+			UserID        string      `bson:"userId"`
+			UserName      string      `bson:"userName"`
+			Total         money.Money `bson:"total"`
+			ServiceCharge money.Money `bson:"serviceCharge"`
+			Tips          money.Money `bson:"tips"`
+			Payments      []struct {
+				Method string      `bson:"method"`
+				Tip    money.Money `bson:"tip"`
+			} `bson:"payments"`
+		}
+		if err := cur.Decode(&s); err != nil {
+			return nil, err
+		}
+		summary.Tips += s.Tips
+		summary.ServiceCharge += s.ServiceCharge
+		for _, p := range s.Payments {
+			if p.Tip != 0 {
+				summary.ByMethod[p.Method] += p.Tip
+			}
+		}
+		st, ok := staff[s.UserID]
+		if !ok {
+			st = &StaffTips{UserID: s.UserID, UserName: s.UserName}
+			staff[s.UserID] = st
+		}
+		st.Sales += s.Total
+		st.ServiceCharge += s.ServiceCharge
+		st.Tips += s.Tips
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	for _, st := range staff {
+		summary.ByStaff = append(summary.ByStaff, *st)
+	}
+	sort.Slice(summary.ByStaff, func(i, j int) bool { return summary.ByStaff[i].UserName < summary.ByStaff[j].UserName })
+	return summary, nil
+}
+
+// distribute shares total out in proportion to the weights, to the penny,
+// so the shares always add up to the total. With no weight nothing is shared.
+func distribute(total money.Money, shares []Share) {
+	weight := 0.0
+	weights := make([]float64, len(shares))
+	for i, s := range shares {
+		weight += s.Weight
+		weights[i] = s.Weight
+	}
+	if weight <= 0 {
+		return
+	}
+	for i, amount := range money.Allocate(total, weights) {
+		shares[i].Amount = amount
+	}
+}
+
+type poolRequest struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	LocationID string `json:"locationId"`
+	Basis      string `json:"basis"`
+	// IncludeServiceCharge pools the service charge along with tips
+	IncludeServiceCharge bool `json:"includeServiceCharge"`
+	// Hours worked in the period, for sharing by hours
+	Hours []struct {
+		UserID   string  `json:"userId"`
+		UserName string  `json:"userName"`
+		Hours    float64 `json:"hours"`
+	} `json:"hours"`
+}
+
+// TipsHandler handles GET /api/tips?from=&to=&locationId= and
+// POST /api/tips/pool
+func TipsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	parts := splitPath(r.URL.Path)
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		q := r.URL.Query()
+		from, to, err := parsePeriod(q.Get("from"), q.Get("to"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid from or to"}`))
+			return
+		}
+		loc, _ := primitive.ObjectIDFromHex(q.Get("locationId"))
+		summary, err := Summarise(ctx, loc, from, to)
+		if err != nil {
+			log.Printf("tips error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	case len(parts) == 3 && parts[2] == "pool" && r.Method == http.MethodPost:
+		var req poolRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid input"}`))
+			return
+		}
+		from, to, err := parsePeriod(req.From, req.To)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid from or to"}`))
+			return
+		}
+		if req.Basis != BasisHours && req.Basis != BasisSales {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"basis must be hours or sales"}`))
+			return
+		}
+		loc, _ := primitive.ObjectIDFromHex(req.LocationID)
+		summary, err := Summarise(ctx, loc, from, to)
+		if err != nil {
+			log.Printf("tips error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"db error"}`))
+			return
+		}
+		pool := Pool{From: from, To: to, Basis: req.Basis, Total: summary.Tips, Shares: []Share{}}
+		if req.IncludeServiceCharge {
+			pool.Total += summary.ServiceCharge
+		}
+		if req.Basis == BasisHours {
+			for _, h := range req.Hours {
+				if h.Hours < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error":"hours can't be negative"}`))
+					return
+				}
+				pool.Shares = append(pool.Shares, Share{UserID: h.UserID, UserName: h.UserName, Weight: h.Hours})
+			}
+			if len(pool.Shares) == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"hours required"}`))
+				return
+			}
+		} else {
+			for _, st := range summary.ByStaff {
+				// Sales taken with no one signed in have nobody to share with
+				if st.UserID != "" && st.Sales > 0 {
+					pool.Shares = append(pool.Shares, Share{UserID: st.UserID, UserName: st.UserName, Weight: st.Sales.Float()})
+				}
+			}
+		}
+		distribute(pool.Total, pool.Shares)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pool)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,79 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"hospos-backend/internal/db"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrNotManager      = errors.New("manager approval required")
+)
+
+// FromRequest resolves the user behind the request's Authorization header.
+// The header carries the token issued by AuthHandler, optionally prefixed
+// with "Bearer ". The user is looked up so a deleted user or a token whose
+// role no longer matches is rejected.
+func FromRequest(ctx context.Context, r *http.Request) (*User, error) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	id, role, ok := strings.Cut(token, ":")
+	if !ok || id == "" {
+		return nil, ErrUnauthenticated
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	coll, err := db.GetCollection("users")
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := coll.FindOne(ctx, bson.M{"_id": objID}).Decode(&user); err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if user.Role != role {
+		return nil, ErrUnauthenticated
+	}
+	return &user, nil
+}
+
+// IsManager reports whether the user may approve manager-only actions
+func (u *User) IsManager() bool {
+	return u.Role == "admin" || u.Role == "manager"
+}
+
+// ManagerApproval returns the manager approving an action, who must give
+// their name and PIN at the till. The session token is not proof of a role,
+// so a signed-in manager still enters their PIN; the name defaults to theirs.
+func ManagerApproval(ctx context.Context, r *http.Request, name, pin string) (*User, error) {
+	if name == "" {
+		if u, err := FromRequest(ctx, r); err == nil {
+			name = u.Name
+		}
+	}
+	if name == "" || pin == "" {
+		return nil, ErrNotManager
+	}
+	coll, err := db.GetCollection("users")
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := coll.FindOne(ctx, bson.M{"name": name}).Decode(&user); err != nil {
+		return nil, ErrNotManager
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Pin), []byte(pin)) != nil || !user.IsManager() {
+		return nil, ErrNotManager
+	}
+	return &user, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"hospos-backend/internal/bookings"
 	"hospos-backend/internal/business"
 	"hospos-backend/internal/customers"
@@ -8,17 +9,24 @@ import (
 	"hospos-backend/internal/devtools"
 	"hospos-backend/internal/discounts"
 	"hospos-backend/internal/finance"
+	"hospos-backend/internal/idempotency"
 	"hospos-backend/internal/inventory"
+	"hospos-backend/internal/kds"
 	"hospos-backend/internal/linking"
 	"hospos-backend/internal/locations"
 	"hospos-backend/internal/payments"
+	"hospos-backend/internal/printing"
 	"hospos-backend/internal/products"
+	"hospos-backend/internal/purchasing"
 	"hospos-backend/internal/receipts"
 	"hospos-backend/internal/reminders"
 	"hospos-backend/internal/reports"
 	"hospos-backend/internal/roles"
 	"hospos-backend/internal/sales"
+	"hospos-backend/internal/shifts"
 	"hospos-backend/internal/sync"
+	"hospos-backend/internal/tabs"
+	"hospos-backend/internal/tips"
 	"hospos-backend/internal/users"
 	"log"
 	"net"
@@ -45,7 +53,8 @@ func withCORS(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Till-ID, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor, Idempotent-Replayed")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -61,8 +70,29 @@ func main() {
 	// Product management
 	mux.HandleFunc("/api/products", withLoggingAndRecovery(withCORS(products.ProductsHandler)))
 	mux.HandleFunc("/api/products/", withLoggingAndRecovery(withCORS(products.ProductByIDHandler)))
+	mux.HandleFunc("/api/price-lists", withLoggingAndRecovery(withCORS(products.PriceListsHandler)))
+	mux.HandleFunc("/api/price-lists/", withLoggingAndRecovery(withCORS(products.PriceListsHandler)))
 	// Sales
-	mux.HandleFunc("/api/sales", withLoggingAndRecovery(withCORS(sales.SalesHandler)))
+	mux.HandleFunc("/api/sales", withLoggingAndRecovery(withCORS(idempotency.Handler(sales.SalesHandler))))
+	mux.HandleFunc("/api/sales/", withLoggingAndRecovery(withCORS(idempotency.Handler(sales.SalesHandler))))
+	// Tabs
+	mux.HandleFunc("/api/tabs", withLoggingAndRecovery(withCORS(idempotency.Handler(tabs.TabsHandler))))
+	mux.HandleFunc("/api/tabs/", withLoggingAndRecovery(withCORS(idempotency.Handler(tabs.TabsHandler))))
+	// Kitchen display; not wrapped for idempotency: the stream needs the
+	// writer's Flush
+	mux.HandleFunc("/api/kds", withLoggingAndRecovery(withCORS(kds.KDSHandler)))
+	mux.HandleFunc("/api/kds/", withLoggingAndRecovery(withCORS(kds.KDSHandler)))
+	// Printers and the print queue
+	mux.HandleFunc("/api/printers", withLoggingAndRecovery(withCORS(printing.PrintersHandler)))
+	mux.HandleFunc("/api/printers/", withLoggingAndRecovery(withCORS(printing.PrintersHandler)))
+	mux.HandleFunc("/api/print-jobs", withLoggingAndRecovery(withCORS(printing.JobsHandler)))
+	mux.HandleFunc("/api/print-jobs/", withLoggingAndRecovery(withCORS(printing.JobsHandler)))
+	// Tips and service charge
+	mux.HandleFunc("/api/tips", withLoggingAndRecovery(withCORS(tips.TipsHandler)))
+	mux.HandleFunc("/api/tips/", withLoggingAndRecovery(withCORS(tips.TipsHandler)))
+	// Till shifts
+	mux.HandleFunc("/api/shifts", withLoggingAndRecovery(withCORS(shifts.ShiftsHandler)))
+	mux.HandleFunc("/api/shifts/", withLoggingAndRecovery(withCORS(shifts.ShiftsHandler)))
 	// Categories
 	mux.HandleFunc("/api/categories", withLoggingAndRecovery(withCORS(products.CategoriesHandler)))
 	// Table bookings
@@ -70,6 +100,18 @@ func main() {
 	mux.HandleFunc("/api/bookings/", withLoggingAndRecovery(withCORS(bookings.BookingsHandler)))
 	// Inventory
 	mux.HandleFunc("/api/inventory", withLoggingAndRecovery(withCORS(inventory.InventoryHandler)))
+	mux.HandleFunc("/api/inventory/", withLoggingAndRecovery(withCORS(inventory.InventoryHandler)))
+	mux.HandleFunc("/api/stocktakes", withLoggingAndRecovery(withCORS(inventory.StocktakesHandler)))
+	mux.HandleFunc("/api/stocktakes/", withLoggingAndRecovery(withCORS(inventory.StocktakesHandler)))
+	mux.HandleFunc("/api/stock-transfers", withLoggingAndRecovery(withCORS(inventory.TransfersHandler)))
+	mux.HandleFunc("/api/stock-transfers/", withLoggingAndRecovery(withCORS(inventory.TransfersHandler)))
+	mux.HandleFunc("/api/waste", withLoggingAndRecovery(withCORS(inventory.WasteHandler)))
+	mux.HandleFunc("/api/waste/", withLoggingAndRecovery(withCORS(inventory.WasteHandler)))
+	// Suppliers and purchase orders
+	mux.HandleFunc("/api/suppliers", withLoggingAndRecovery(withCORS(purchasing.SuppliersHandler)))
+	mux.HandleFunc("/api/suppliers/", withLoggingAndRecovery(withCORS(purchasing.SuppliersHandler)))
+	mux.HandleFunc("/api/purchase-orders", withLoggingAndRecovery(withCORS(purchasing.PurchaseOrdersHandler)))
+	mux.HandleFunc("/api/purchase-orders/", withLoggingAndRecovery(withCORS(purchasing.PurchaseOrdersHandler)))
 	// Users
 	mux.HandleFunc("/api/users", withLoggingAndRecovery(withCORS(users.UsersHandler)))
 	mux.HandleFunc("/api/users/", withLoggingAndRecovery(withCORS(users.UsersHandler)))
@@ -83,7 +125,7 @@ func main() {
 	mux.HandleFunc("/api/customers", withLoggingAndRecovery(withCORS(customers.CustomersHandler)))
 	mux.HandleFunc("/api/customers/", withLoggingAndRecovery(withCORS(customers.CustomersHandler)))
 	// Payments
-	mux.HandleFunc("/api/payments", withLoggingAndRecovery(withCORS(payments.PaymentsHandler)))
+	mux.HandleFunc("/api/payments", withLoggingAndRecovery(withCORS(idempotency.Handler(payments.PaymentsHandler))))
 	// Receipts
 	mux.HandleFunc("/api/receipts", withLoggingAndRecovery(withCORS(receipts.ReceiptsHandler)))
 	// Discounts
@@ -91,6 +133,7 @@ func main() {
 	mux.HandleFunc("/api/discounts/", withLoggingAndRecovery(withCORS(discounts.DiscountsHandler)))
 	// Locations
 	mux.HandleFunc("/api/locations", withLoggingAndRecovery(withCORS(locations.LocationsHandler)))
+	mux.HandleFunc("/api/locations/", withLoggingAndRecovery(withCORS(locations.LocationsHandler)))
 	// Offline sync
 	mux.HandleFunc("/api/sync", withLoggingAndRecovery(withCORS(sync.SyncHandler)))
 	// Linking (till registration)
@@ -132,6 +175,12 @@ func main() {
 	} else {
 		log.Printf("External IP address: %s", ip)
 	}
+	// Apply pending data migrations before taking requests, so nothing is
+	// written in the old shape while they run
+	if err := dbinit.RunMigrations(); err != nil {
+		log.Fatalf("Migrations failed: %v", err)
+	}
+	go printing.Start(context.Background())
 	log.Printf("Starting server on :%s...", port)
 	if err := http.ListenAndServe(":"+port, mux); err != nil {
 		log.Fatalf("Server failed: %v", err)
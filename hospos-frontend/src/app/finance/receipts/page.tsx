@@ -4,6 +4,7 @@ import { useEffect, useState } from "react";
 interface Receipt {
   id: string;
   sale_id: string;
+  saleNumber?: string;
   createdAt?: string;
   // Add more fields as needed
 }
@@ -40,7 +41,7 @@ export default function ReceiptsPage() {
           <thead>
             <tr className="bg-gray-100 dark:bg-gray-800">
               <th className="p-2 text-left">Receipt ID</th>
-              <th className="p-2 text-left">Sale ID</th>
+              <th className="p-2 text-left">Sale No.</th>
               <th className="p-2 text-left">Created At</th>
             </tr>
           </thead>
@@ -48,7 +49,7 @@ export default function ReceiptsPage() {
             {receipts.map((r) => (
               <tr key={r.id} className="border-t">
                 <td className="p-2">{r.id}</td>
-                <td className="p-2">{r.sale_id}</td>
+                <td className="p-2">{r.saleNumber || r.sale_id}</td>
                 <td className="p-2">{r.createdAt ? new Date(r.createdAt).toLocaleString() : "-"}</td>
               </tr>
             ))}
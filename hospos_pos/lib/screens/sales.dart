@@ -32,6 +32,9 @@ class _SalesScreenState extends State<SalesScreen> {
 
   double get _cartSubtotal => _cart.fold(0.0, (sum, item) => sum + (item['price'] * item['qty']));
   double get _cartTax => _cartSubtotal * 0.2 / 1.2; // 20% VAT included
+  double get _cartDiscount => _selectedDiscountId != null ? _cartSubtotal * (_selectedDiscountPercent / 100) : 0;
+  // VAT is charged on what the customer pays, after any discount
+  double get _saleTax => (_cartSubtotal - _cartDiscount) * 0.2 / 1.2;
 
   @override
   void initState() {
@@ -384,8 +387,9 @@ class _SalesScreenState extends State<SalesScreen> {
             "price": item['price'],
           }).toList(),
           "total": _cartSubtotal - (_selectedDiscountId != null ? _cartSubtotal * (_selectedDiscountPercent / 100) : 0),
-          "vat": _cartTax,
-          "discount": _selectedDiscountId != null ? _cartSubtotal * (_selectedDiscountPercent / 100) : 0,
+          "vat": _saleTax,
+          "discount": _cartDiscount,
+          if (_selectedDiscountId != null) "discountId": _selectedDiscountId,
           "paid": result['cash'] + result['card'],
           "payments": [
             if (result['cash'] > 0) {"amount": result['cash'], "method": "cash"},
@@ -405,7 +409,7 @@ class _SalesScreenState extends State<SalesScreen> {
             });
             ScaffoldMessenger.of(context).showSnackBar(
               SnackBar(
-                content: Text('Payment complete: Cash £${result['cash'].toStringAsFixed(2)}, Card £${result['card'].toStringAsFixed(2)}'),
+                content: Text('Sale ${response['number'] ?? ''} complete: Cash £${result['cash'].toStringAsFixed(2)}, Card £${result['card'].toStringAsFixed(2)}'),
                 backgroundColor: Colors.indigo,
               ),
             );
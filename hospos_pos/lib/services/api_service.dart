@@ -1,4 +1,5 @@
 import 'dart:convert';
+import 'dart:math';
 import 'package:http/http.dart' as http;
 import 'package:shared_preferences/shared_preferences.dart';
 
@@ -16,6 +17,15 @@ class ApiService {
     return [];
   }
   static String? _baseUrl; // Not set by default
+  static String? _tillId; // Set once the terminal is linked
+  static String? _token; // Set by login
+
+  // Headers identifying this till and the signed-in user
+  static Map<String, String> get _headers => {
+        'Content-Type': 'application/json',
+        if (_tillId != null) 'X-Till-ID': _tillId!,
+        if (_token != null) 'Authorization': 'Bearer $_token',
+      };
 
   // Get categories
   static Future<List<String>> getCategories() async {
@@ -37,6 +47,7 @@ class ApiService {
     if (ip != null && ip.isNotEmpty) {
       _baseUrl = 'http://$ip:8080/api';
     }
+    _tillId = prefs.getString('till_id');
   }
 
   static Future<void> setServerIp(String ip) async {
@@ -58,25 +69,54 @@ class ApiService {
         body: jsonEncode({'linkCode': code, 'deviceInfo': {}}),
         headers: {'Content-Type': 'application/json'},
       ).timeout(const Duration(seconds: 5));
-      return response.statusCode == 200;
+      if (response.statusCode != 200) return false;
+      final tillId = jsonDecode(response.body)['tillId'];
+      if (tillId is String && tillId.isNotEmpty) {
+        final prefs = await SharedPreferences.getInstance();
+        await prefs.setString('till_id', tillId);
+        _tillId = tillId;
+      }
+      return true;
     } catch (e) {
       // Optionally log error
       return false;
     }
   }
 
-static Future<Map<String, dynamic>?> postSale(Map<String, dynamic> sale) async {
+// A fresh key per sale lets the server spot a resend of the same sale
+static String newIdempotencyKey() {
+  final random = Random.secure();
+  return List.generate(16, (_) => random.nextInt(256).toRadixString(16).padLeft(2, '0')).join();
+}
+
+// Posts a sale, resending with the same idempotency key if the request times
+// out or the connection drops, so a flaky network can't record it twice
+static Future<Map<String, dynamic>?> postSale(Map<String, dynamic> sale, {String? idempotencyKey, int attempts = 3}) async {
   if (_baseUrl == null) return null;
-  try {
-    final response = await http.post(
-      Uri.parse('$_baseUrl/sales'),
-      headers: {'Content-Type': 'application/json'},
-      body: jsonEncode(sale),
-    );
-    if (response.statusCode == 201) {
-      return jsonDecode(response.body);
+  final key = idempotencyKey ?? newIdempotencyKey();
+  final body = jsonEncode(sale);
+  for (var attempt = 1; attempt <= attempts; attempt++) {
+    try {
+      final response = await http.post(
+        Uri.parse('$_baseUrl/sales'),
+        headers: {..._headers, 'Idempotency-Key': key},
+        body: body,
+      ).timeout(const Duration(seconds: 10));
+      if (response.statusCode == 201) {
+        return jsonDecode(response.body);
+      }
+      // Still being processed from an earlier attempt
+      if (response.statusCode == 409 && response.headers['retry-after'] != null) {
+        await Future.delayed(const Duration(seconds: 1));
+        continue;
+      }
+      return null;
+    } catch (_) {
+      if (attempt < attempts) {
+        await Future.delayed(Duration(seconds: attempt));
+      }
     }
-  } catch (_) {}
+  }
   return null;
 }
 
@@ -105,7 +145,9 @@ static Future<Map<String, dynamic>?> postSale(Map<String, dynamic> sale) async {
         headers: {'Content-Type': 'application/json'},
       );
       if (response.statusCode == 200) {
-        return jsonDecode(response.body);
+        final result = jsonDecode(response.body);
+        _token = result['token'];
+        return result;
       }
     } catch (_) {}
     return null;